@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	cfm "github.com/aws/aws-sdk-go/service/cloudformation"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Approval modes of update-policy.
+const (
+	approvalBatch   = "batch"
+	approvalAccount = "account"
+)
+
+// stdin is where approvals are read from, tests replace it with canned answers.
+var stdin io.Reader = os.Stdin
+
+// promptIn buffers promptSrc, the stdin the questions were last read from.
+var (
+	promptMu  sync.Mutex
+	promptIn  *bufio.Reader
+	promptSrc io.Reader
+)
+
+// isInteractive reports whether approvals can be asked for on the terminal.
+var isInteractive = func() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// destructive reports whether the change deletes or replaces a resource.
+func (c policyChange) destructive() bool {
+	return c.Action == cfm.ChangeActionRemove || c.Replacement == cfm.ReplacementTrue || c.Replacement == cfm.ReplacementConditional
+}
+
+// iamGuardedTypes are the IAM resource types that are not replaced or removed without an explicit
+// allowance, replacing them breaks the trust relationships and group memberships built on them.
+var iamGuardedTypes = map[string]bool{
+	"AWS::IAM::Role":          true,
+	"AWS::IAM::Policy":        true,
+	"AWS::IAM::ManagedPolicy": true,
+	"AWS::IAM::Group":         true,
+	"AWS::IAM::RolePolicy":    true,
+	"AWS::IAM::GroupPolicy":   true,
+}
+
+// blockedChanges returns the changes replacing or removing IAM roles, policies or groups of an
+// account that the allowlist of the configuration does not permit.
+func blockedChanges(cfg Config, alias string, changes []policyChange) []policyChange {
+	var blocked []policyChange
+	for _, c := range changes {
+		if iamGuardedTypes[c.ResourceType] && c.destructive() && !cfg.replacementAllowed(alias, c.LogicalID) {
+			blocked = append(blocked, c)
+		}
+	}
+	return blocked
+}
+
+// approveChangeSets asks for the approval of the change sets with changes, once for the batch or
+// once per account. Rejected change sets are discarded and removed from changeSets. Without a
+// terminal to ask on, the change sets are approved unless some delete or replace resources, then
+// nothing is executed without AutoApprove.
+func approveChangeSets(results []policyResult, changeSets []*policyChangeSet, opts policyOptions) error {
+	if opts.AutoApprove {
+		return nil
+	}
+	var pending []int
+	for i, cs := range changeSets {
+		if cs != nil && cs.outcome != outcomeNoChange {
+			pending = append(pending, i)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if !isInteractive() {
+		var destructive []policyResult
+		var names []string
+		for _, i := range pending {
+			for _, c := range results[i].Changes {
+				if c.destructive() {
+					destructive = append(destructive, results[i])
+					names = append(names, results[i].name())
+					break
+				}
+			}
+		}
+		if len(destructive) == 0 {
+			return nil
+		}
+		printPolicyChanges(os.Stdout, destructive)
+		return fmt.Errorf("ERROR: Refusing to delete or replace resources of %s without a terminal to approve it, use --auto-approve", strings.Join(names, ", "))
+	}
+
+	// groups are the change sets approved together.
+	groups := [][]int{pending}
+	if opts.Approval == approvalAccount {
+		groups = nil
+		group := make(map[string]int)
+		for _, i := range pending {
+			g, ok := group[results[i].Alias]
+			if !ok {
+				g = len(groups)
+				group[results[i].Alias] = g
+				groups = append(groups, nil)
+			}
+			groups[g] = append(groups[g], i)
+		}
+	}
+	for _, g := range groups {
+		var shown []policyResult
+		for _, i := range g {
+			shown = append(shown, results[i])
+		}
+		printPolicyChanges(os.Stdout, shown)
+		question := fmt.Sprintf("Execute the change sets of %d stack(s)?", len(g))
+		if opts.Approval == approvalAccount {
+			question = fmt.Sprintf("Execute the change sets of %s?", results[g[0]].Alias)
+		}
+		if ask(question) {
+			continue
+		}
+		for _, i := range g {
+			results[i].Outcome = outcomeRejected
+			if err := changeSets[i].discard(); err != nil {
+				results[i].Outcome, results[i].Err = outcomeFailed, err
+			}
+			changeSets[i] = nil
+		}
+	}
+	return nil
+}
+
+// ask asks a yes or no question on the terminal, any answer but y or yes is a no. Questions
+// asked at the same time from several goroutines are asked one after the other.
+func ask(question string) bool {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+	if promptSrc != stdin {
+		promptIn, promptSrc = bufio.NewReader(stdin), stdin
+	}
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := promptIn.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
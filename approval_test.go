@@ -0,0 +1,157 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	cfm "github.com/aws/aws-sdk-go/service/cloudformation"
+	"strings"
+	"testing"
+)
+
+// setupApprovalTest deploys the stacks of the dev and qa accounts, so that a run with a new
+// parameter has changes to approve. It returns the account IDs by alias.
+func setupApprovalTest(t *testing.T) (*fakeClients, map[string]string) {
+	t.Helper()
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	ids := make(map[string]string)
+	var accounts []Account
+	for _, alias := range []string{"dev", "qa"} {
+		ids[alias] = fake.org.AddAccount(fake.org.RootID(), alias, alias+"@example.com")
+		accounts = append(accounts, Account{ID: ids[alias], Alias: alias, Email: alias + "@example.com", TemplateFile: writeTemplate(t, strings.Title(alias)+"-Policies")})
+	}
+	writeOrgYaml(Organization{Accounts: []Account{iam}, OrganizationalUnits: []OrganizationalUnit{{Name: "Workloads", Accounts: accounts}}})
+	if err := UpdatePolicies(testConfig, []string{"dev", "qa"}, policyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return fake, ids
+}
+
+// executed reports whether the run with the Env parameter reached the stack.
+func executed(fake *fakeClients, id, stack string) bool {
+	for _, p := range fake.account(id).Stack(stack).Parameters {
+		if *p.ParameterKey == "Env" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestApproveChangeSets(t *testing.T) {
+	tests := []struct {
+		name     string
+		answers  string
+		approval string
+		wantDev  bool
+		wantQa   bool
+		wantErr  string
+		nonTTY   bool
+		removal  bool
+		auto     bool
+	}{
+		{name: "batch approved", answers: "y\n", wantDev: true, wantQa: true},
+		{name: "batch rejected", answers: "n\n"},
+		{name: "no answer", answers: ""},
+		{name: "per account", answers: "yes\nno\n", approval: approvalAccount, wantDev: true},
+		{name: "non-interactive", nonTTY: true, wantDev: true, wantQa: true},
+		{name: "non-interactive removal", nonTTY: true, removal: true, wantErr: "Refusing to delete or replace resources of dev/us-west-2"},
+		{name: "auto-approved removal", nonTTY: true, removal: true, auto: true, wantDev: true, wantQa: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, ids := setupApprovalTest(t)
+			stdin = strings.NewReader(tt.answers)
+			isInteractive = func() bool { return !tt.nonTTY }
+			for alias, id := range ids {
+				action := cfm.ChangeActionModify
+				if tt.removal && alias == "dev" {
+					action = cfm.ChangeActionRemove
+				}
+				fake.account(id).Changes[strings.Title(alias)+"-Policies"] = []*cfm.Change{{ResourceChange: &cfm.ResourceChange{
+					Action:            aws.String(action),
+					LogicalResourceId: aws.String("Settings"),
+					ResourceType:      aws.String("AWS::SSM::Parameter"),
+				}}}
+			}
+
+			opts := policyOptions{Parameters: map[string]string{"Env": "test"}, Approval: tt.approval, AutoApprove: tt.auto}
+			err := UpdatePolicies(testConfig, []string{"dev", "qa"}, opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := executed(fake, ids["dev"], "Dev-Policies"); got != tt.wantDev {
+				t.Errorf("dev executed = %v, want %v", got, tt.wantDev)
+			}
+			if got := executed(fake, ids["qa"], "Qa-Policies"); got != tt.wantQa {
+				t.Errorf("qa executed = %v, want %v", got, tt.wantQa)
+			}
+		})
+	}
+}
+
+func TestBlockedReplacements(t *testing.T) {
+	tests := []struct {
+		name         string
+		resourceType string
+		replacement  string
+		allow        bool
+		allowlist    []string
+		blocked      bool
+	}{
+		{name: "role replaced", resourceType: "AWS::IAM::Role", replacement: cfm.ReplacementTrue, blocked: true},
+		{name: "conditional replacement", resourceType: "AWS::IAM::ManagedPolicy", replacement: cfm.ReplacementConditional, blocked: true},
+		{name: "in-place update", resourceType: "AWS::IAM::Role", replacement: cfm.ReplacementFalse},
+		{name: "not iam", resourceType: "AWS::S3::Bucket", replacement: cfm.ReplacementTrue},
+		{name: "allowed by flag", resourceType: "AWS::IAM::Role", replacement: cfm.ReplacementTrue, allow: true},
+		{name: "allowed by config", resourceType: "AWS::IAM::Group", replacement: cfm.ReplacementTrue, allowlist: []string{"dev/Developer*"}},
+		{name: "allowed for another account", resourceType: "AWS::IAM::Group", replacement: cfm.ReplacementTrue, allowlist: []string{"qa/DeveloperRole"}, blocked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, ids := setupApprovalTest(t)
+			fake.account(ids["dev"]).Changes["Dev-Policies"] = []*cfm.Change{{ResourceChange: &cfm.ResourceChange{
+				Action:            aws.String(cfm.ChangeActionModify),
+				LogicalResourceId: aws.String("DeveloperRole"),
+				ResourceType:      aws.String(tt.resourceType),
+				Replacement:       aws.String(tt.replacement),
+			}}}
+			cfg := testConfig
+			cfg.AllowReplacement = tt.allowlist
+
+			opts := policyOptions{Parameters: map[string]string{"Env": "test"}, AutoApprove: true, AllowReplacement: tt.allow}
+			err := UpdatePolicies(cfg, []string{"dev", "qa"}, opts)
+			if tt.blocked {
+				if err == nil || !strings.Contains(err.Error(), "dev/us-west-2") {
+					t.Fatalf("err = %v", err)
+				}
+				if executed(fake, ids["dev"], "Dev-Policies") {
+					t.Error("the blocked change set was executed")
+				}
+				if !executed(fake, ids["qa"], "Qa-Policies") {
+					t.Error("the other account was not updated")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !executed(fake, ids["dev"], "Dev-Policies") {
+				t.Error("the change set was not executed")
+			}
+		})
+	}
+}
+
+func TestBlockedChangesReport(t *testing.T) {
+	changes := []policyChange{
+		{Action: cfm.ChangeActionRemove, LogicalID: "LegacyPolicy", ResourceType: "AWS::IAM::Policy"},
+		{Action: cfm.ChangeActionAdd, LogicalID: "AuditPolicy", ResourceType: "AWS::IAM::ManagedPolicy"},
+	}
+	blocked := blockedChanges(testConfig, "dev", changes)
+	if len(blocked) != 1 || blocked[0].LogicalID != "LegacyPolicy" {
+		t.Errorf("blocked = %+v", blocked)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	cli "github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	defaultConfigFile = "governor.yaml"
+	defaultStackName  = "{Alias}-Policies"
+	defaultTemplate   = "policies/template_policy.json"
+)
+
+// Config holds the settings of the tool, read from governor.yaml and overridden by flags
+// and environment variables.
+type Config struct {
+	// TemplateBucket is the S3 bucket the policy templates over the inline size limit are uploaded to.
+	TemplateBucket string `yaml:"template_bucket"`
+	// Region is the home region. It holds the template bucket and the policy stack of every
+	// account, accounts and OUs with regions get their stack in those regions as well.
+	Region string `yaml:"region"`
+	// AccountAccessRole is the role assumed in member accounts to deploy their stacks.
+	AccountAccessRole string `yaml:"account_access_role"`
+	// StackName is the name of the policy stack of an account. {alias} is replaced by the
+	// account alias and {Alias} by the alias in title case.
+	StackName string `yaml:"stack_name"`
+	// AllowReplacement lists the IAM resources that may be replaced or removed, as alias/LogicalID
+	// patterns like dev/DeveloperRole or */LegacyPolicy. A pattern without a slash matches the
+	// logical ID in every account.
+	AllowReplacement []string `yaml:"allow_replacement"`
+	// TemplateSharing is how the member accounts read the templates: org-policy manages a bucket
+	// policy statement letting the organization read them, presigned passes presigned URLs.
+	TemplateSharing string `yaml:"template_sharing"`
+	// DefaultTemplate is the policy template of the accounts without a template of their own. A
+	// *.tmpl template is rendered for every account, see readPolicyTemplate.
+	DefaultTemplate string `yaml:"default_template"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Region:            defaultRegion,
+		AccountAccessRole: defaultAccountAccessRole,
+		StackName:         defaultStackName,
+		TemplateSharing:   sharingOrgPolicy,
+		DefaultTemplate:   defaultTemplate,
+	}
+}
+
+// configFlags are the global flags overriding the settings of governor.yaml.
+func configFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "config", Value: defaultConfigFile, Usage: "Path of the tool configuration `file`", EnvVars: []string{"GOVERNOR_CONFIG"}},
+		&cli.StringFlag{Name: "template-bucket", Usage: "S3 `bucket` for the policy templates", EnvVars: []string{"GOVERNOR_TEMPLATE_BUCKET"}},
+		&cli.StringFlag{Name: "region", Usage: "home `region` of the policy stacks and the template bucket", EnvVars: []string{"GOVERNOR_REGION"}},
+		&cli.StringFlag{Name: "account-access-role", Usage: "`name` of the role assumed in member accounts", EnvVars: []string{"GOVERNOR_ACCOUNT_ACCESS_ROLE"}},
+		&cli.StringFlag{Name: "stack-name", Usage: "`format` of the policy stack names, like {Alias}-Policies", EnvVars: []string{"GOVERNOR_STACK_NAME"}},
+		&cli.StringFlag{Name: "template-sharing", Usage: "how accounts read the templates, `mode` org-policy or presigned", EnvVars: []string{"GOVERNOR_TEMPLATE_SHARING"}},
+	}
+}
+
+// loadConfig reads the configuration file and applies the flag and environment overrides.
+// A missing file is only an error when its path was given explicitly.
+func loadConfig(ctx *cli.Context) (Config, error) {
+	cfg := defaultConfig()
+	path := ctx.String("config")
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !(os.IsNotExist(err) && !ctx.IsSet("config")) {
+		return cfg, fmt.Errorf("ERROR: Failed to read the configuration file %s: %v", path, err)
+	}
+	if err == nil {
+		if err := yaml.UnmarshalStrict(content, &cfg); err != nil {
+			return cfg, fmt.Errorf("ERROR: Failed in unmarshalling the configuration file %s: %v", path, err)
+		}
+	}
+	overrides := map[string]*string{
+		"template-bucket":     &cfg.TemplateBucket,
+		"region":              &cfg.Region,
+		"account-access-role": &cfg.AccountAccessRole,
+		"stack-name":          &cfg.StackName,
+		"template-sharing":    &cfg.TemplateSharing,
+	}
+	for name, setting := range overrides {
+		if ctx.IsSet(name) {
+			*setting = ctx.String(name)
+		}
+	}
+	return cfg, nil
+}
+
+// stackName returns the name of the policy stack of an account.
+func (c Config) stackName(alias string) string {
+	return strings.NewReplacer("{alias}", alias, "{Alias}", strings.Title(alias)).Replace(c.StackName)
+}
+
+// replacementAllowed reports whether the allowlist permits replacing or removing a resource of an account.
+func (c Config) replacementAllowed(alias, logicalID string) bool {
+	for _, pattern := range c.AllowReplacement {
+		name := alias + "/" + logicalID
+		if !strings.Contains(pattern, "/") {
+			name = logicalID
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// templateFile returns the policy template file of an account.
+func (c Config) templateFile(a Account) string {
+	if a.TemplateFile != "" {
+		return a.TemplateFile
+	}
+	return c.DefaultTemplate
+}
+
+// accountRoleARN returns the ARN of the role assumed to deploy stacks in an account.
+func (c Config) accountRoleARN(accountID string) string {
+	return fmt.Sprintf("arn:aws:iam::%s:role/%s", accountID, c.AccountAccessRole)
+}
+
+// templateURL returns the URL of an uploaded policy template.
+func (c Config) templateURL(key string) string {
+	return fmt.Sprintf("https://%s.s3-%s.amazonaws.com/%s", c.TemplateBucket, c.Region, key)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	cli "github.com/urfave/cli/v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// runWithConfig loads the configuration the way the app does for the given arguments.
+func runWithConfig(t *testing.T, args ...string) (Config, error) {
+	t.Helper()
+	var cfg Config
+	var err error
+	app := &cli.App{
+		Flags: configFlags(),
+		Action: func(ctx *cli.Context) error {
+			cfg, err = loadConfig(ctx)
+			return nil
+		},
+	}
+	if rerr := app.Run(append([]string{"governor"}, args...)); rerr != nil {
+		t.Fatal(rerr)
+	}
+	return cfg, err
+}
+
+func TestLoadConfig(t *testing.T) {
+	setupTest(t, Organization{})
+
+	cfg, err := runWithConfig(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg, defaultConfig()) {
+		t.Errorf("config without governor.yaml = %+v, want the defaults", cfg)
+	}
+
+	if _, err := runWithConfig(t, "--config", "missing.yaml"); err == nil {
+		t.Error("an explicit missing configuration file should fail")
+	}
+
+	content := "template_bucket: policy-templates\nregion: eu-west-1\nstack_name: org-{alias}\nallow_replacement: [dev/DeveloperRole]\ntemplate_sharing: presigned\n"
+	if err := ioutil.WriteFile(defaultConfigFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("GOVERNOR_REGION", "eu-central-1")
+	defer os.Unsetenv("GOVERNOR_REGION")
+	cfg, err = runWithConfig(t, "--template-bucket", "other-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Config{TemplateBucket: "other-bucket", Region: "eu-central-1", AccountAccessRole: defaultAccountAccessRole, StackName: "org-{alias}", AllowReplacement: []string{"dev/DeveloperRole"}, TemplateSharing: sharingPresigned, DefaultTemplate: defaultTemplate}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("config = %+v, want %+v", cfg, want)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(".", defaultConfigFile), []byte("bucket: typo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runWithConfig(t); err == nil {
+		t.Error("unknown configuration keys should fail")
+	}
+}
+
+func TestConfigNames(t *testing.T) {
+	cfg := Config{TemplateBucket: "templates", Region: "eu-west-1", AccountAccessRole: "GovernorRole", StackName: "{Alias}-Policies"}
+	if got := cfg.stackName("dev"); got != "Dev-Policies" {
+		t.Errorf("stackName = %q", got)
+	}
+	cfg.StackName = "org-{alias}"
+	if got := cfg.stackName("dev"); got != "org-dev" {
+		t.Errorf("stackName = %q", got)
+	}
+	if got := cfg.accountRoleARN("100000000001"); got != "arn:aws:iam::100000000001:role/GovernorRole" {
+		t.Errorf("accountRoleARN = %q", got)
+	}
+	cfg.AllowReplacement = []string{"dev/DeveloperRole", "*/Legacy*", "AuditPolicy"}
+	allowed := map[[2]string]bool{
+		{"dev", "DeveloperRole"}: true,
+		{"qa", "DeveloperRole"}:  false,
+		{"qa", "LegacyPolicy"}:   true,
+		{"qa", "AuditPolicy"}:    true,
+	}
+	for k, want := range allowed {
+		if got := cfg.replacementAllowed(k[0], k[1]); got != want {
+			t.Errorf("replacementAllowed(%s, %s) = %v, want %v", k[0], k[1], got, want)
+		}
+	}
+	if got := cfg.templateURL("Dev-Policies"); got != "https://templates.s3-eu-west-1.amazonaws.com/Dev-Policies" {
+		t.Errorf("templateURL = %q", got)
+	}
+}
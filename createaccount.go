@@ -4,66 +4,33 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/organizations"
-	"io/ioutil"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
 	"log"
-	"strings"
 	"time"
 )
 
-func CreateAccount(acc Account) error {
-	var OrganizationUnitID, ParentID string
-	orgC := makeOrgClient(profile, orgRole)
-	if acc.root != "" {
-		Lro, err := orgC.ListRoots(&organizations.ListRootsInput{})
-		if err != nil {
-			return fmt.Errorf("ERROR: Failed to list the roots in organization")
-		}
-		ParentID = *Lro.Roots[0].Id
-		// Script is limited to check the OrganizationalUnits upto 1 level
-		// TODO: Check for all the levels
-		ListOrgUnitsInput := &organizations.ListOrganizationalUnitsForParentInput{
-			ParentId: Lro.Roots[0].Id,
-		}
+// accountStatusPollInterval is the wait between two checks of an account creation request.
+var accountStatusPollInterval = 60 * time.Second
 
-		ListOrgUnitOutput, err := orgC.ListOrganizationalUnitsForParent(ListOrgUnitsInput)
-		if err != nil {
-			return fmt.Errorf("ERROR: Failed to list Organizational units under master")
-		}
-		ouExists := false
-		for _, i := range ListOrgUnitOutput.OrganizationalUnits {
-			if *i.Name == acc.root {
-				OrganizationUnitID = *i.Id
-				ouExists = true
-				break
-			}
-		}
-		if !ouExists {
-			log.Printf("INFO: OrganizationUnit %s does not exist", acc.root)
-			return nil
-		}
-	}
-	accountsList, err := orgC.ListAccounts(&organizations.ListAccountsInput{})
+// moveAccountBackoff is the wait before the first retry of a failed account move, doubled on every retry.
+var moveAccountBackoff = 2 * time.Second
+
+const moveAccountAttempts = 5
+
+func CreateAccount(cfg Config, acc Account) error {
+	orgC := makeOrgClient(profile, orgRole)
+	live, err := loadLiveOrganization(orgC)
 	if err != nil {
-		return fmt.Errorf("ERROR: Failed to list accounts: %v", err)
-	}
-	//TODO: Reduce the duplicacy with the NextToken
-	for _, l := range accountsList.Accounts {
-		if *l.Name == acc.Alias {
-			return fmt.Errorf("ERROR: The account %s is already existed. Try using another name.", acc.Alias)
-		}
+		return err
 	}
-	nextT := accountsList.NextToken
-	for nextT != nil {
-		accountsList, err := orgC.ListAccounts(&organizations.ListAccountsInput{NextToken: nextT})
+	if acc.root != "" {
+		acc.root, err = resolveOUPath(mapKeys(live.paths()), acc.root)
 		if err != nil {
-			return fmt.Errorf("ERROR: Failed to list accounts: %v", err)
+			return fmt.Errorf("ERROR: OrganizationUnit could not be resolved: %v", err)
 		}
-		for _, l := range accountsList.Accounts {
-			if acc.Alias == *l.Name {
-				return fmt.Errorf("ERROR: The account %s is already existed. Try using another name.", acc.Alias)
-			}
-		}
-		nextT = accountsList.NextToken
+	}
+	if la, _ := live.findAccount("", acc.Alias); la != nil {
+		return fmt.Errorf("ERROR: The account %s is already existed. Try using another name.", acc.Alias)
 	}
 
 	accInput := &organizations.CreateAccountInput{
@@ -76,58 +43,124 @@ func CreateAccount(acc Account) error {
 	if err != nil {
 		return fmt.Errorf("ERROR: Account %s creation failed with: %v", acc.Alias, err)
 	}
+	entry := journalEntry{
+		RequestID: *accOutput.CreateAccountStatus.Id,
+		Alias:     acc.Alias,
+		Email:     acc.Email,
+		OU:        acc.root,
+		Step:      stepRequested,
+	}
+	recordJournal(entry)
+	return continueAccountCreation(cfg, orgC, entry)
+}
+
+// continueAccountCreation runs the creation steps that follow the last completed step of the
+// journal entry, recording each step in the journal as it completes.
+func continueAccountCreation(cfg Config, orgC organizationsiface.OrganizationsAPI, entry journalEntry) error {
+	var err error
+	acc := Account{ID: entry.AccountID, Alias: entry.Alias, Email: entry.Email, root: entry.OU}
 
-	accCreateRequestId := accOutput.CreateAccountStatus.Id
+	if entry.Step == stepRequested {
+		acc.ID, err = waitForAccountCreation(orgC, acc.Alias, aws.String(entry.RequestID))
+		if err != nil {
+			return err
+		}
+		entry.AccountID = acc.ID
+		entry.Step = stepSucceeded
+		recordJournal(entry)
+	}
 
+	if entry.Step == stepSucceeded {
+		if acc.root != "" {
+			log.Printf("INFO: Moving account %s from root to %s", acc.Alias, acc.root)
+			live, err := loadLiveOrganization(orgC)
+			if err != nil {
+				return err
+			}
+			dst := live.paths()[acc.root]
+			if dst == nil {
+				return fmt.Errorf("ERROR: Destination organizational unit %s of account %s does not exist", acc.root, acc.Alias)
+			}
+			_, parentID := live.findAccount(acc.ID, "")
+			if parentID != dst.ID {
+				err := moveAccount(orgC, acc.ID, parentID, dst.ID)
+				if err != nil {
+					// Record the account under its destination OU so it is not lost, the OU is added to
+					// organization.yaml when it is missing. apply or resume completes the move later.
+					acc.State = accountStatePendingMove
+					updateOrgYaml(acc)
+					return fmt.Errorf("ERROR: Failed to move the account %s to the destination organizational unit %s, it is recorded as %s: %v", acc.Alias, acc.root, accountStatePendingMove, err)
+				}
+			}
+		}
+		entry.Step = stepMoved
+		recordJournal(entry)
+	}
+
+	// The account has no template of its own, the default template serves it.
+	if entry.Step == stepMoved || entry.Step == stepTemplated {
+		updateOrgYaml(acc)
+		entry.Step = stepYamlWritten
+		recordJournal(entry)
+	}
+
+	if entry.Step == stepYamlWritten {
+		// The stack of a new account only adds resources, there is nothing to approve.
+		err = UpdatePolicies(cfg, []string{acc.Alias}, policyOptions{UpdateIAM: true, AutoApprove: true})
+		if err != nil {
+			return err
+		}
+		entry.Step = stepPoliciesApplied
+		recordJournal(entry)
+	}
+	return nil
+}
+
+// waitForAccountCreation polls the create account request until it finishes and returns the new account ID.
+func waitForAccountCreation(orgC organizationsiface.OrganizationsAPI, alias string, accCreateRequestId *string) (string, error) {
 	descCreateStatusInput := &organizations.DescribeCreateAccountStatusInput{
 		CreateAccountRequestId: accCreateRequestId,
 	}
 
-	accCreated := false
 	for i := 0; i < 15; i++ {
-		descCreateStatusOutput, _ := orgC.DescribeCreateAccountStatus(descCreateStatusInput)
-		if *descCreateStatusOutput.CreateAccountStatus.State == "IN_PROGRESS" {
-			time.Sleep(60 * time.Second)
+		descCreateStatusOutput, err := orgC.DescribeCreateAccountStatus(descCreateStatusInput)
+		if err != nil {
+			// The request goes on in AWS, the journal is left at requested so resume can wait again.
+			return "", fmt.Errorf("ERROR: Failed to check the creation of account %s, run resume to continue: %v", alias, err)
+		}
+		status := descCreateStatusOutput.CreateAccountStatus
+		if aws.StringValue(status.State) == "IN_PROGRESS" {
+			time.Sleep(accountStatusPollInterval)
 			continue
-		} else if *descCreateStatusOutput.CreateAccountStatus.State == "SUCCEEDED" {
-			accCreated = true
-			acc.ID = *descCreateStatusOutput.CreateAccountStatus.AccountId
-			log.Printf("INFO: Account is created succesfully with ID: %s \n", acc.ID)
-			break
+		} else if aws.StringValue(status.State) == "SUCCEEDED" {
+			accID := aws.StringValue(status.AccountId)
+			log.Printf("INFO: Account is created succesfully with ID: %s \n", accID)
+			return accID, nil
 		} else {
-			return fmt.Errorf("Account %s creation failed with %s", acc.Alias, *descCreateStatusOutput.CreateAccountStatus.FailureReason)
+			return "", fmt.Errorf("Account %s creation failed with %s", alias, aws.StringValue(status.FailureReason))
 		}
 	}
-	if !accCreated {
-		return fmt.Errorf("Account Creation took too long to complete. Please have a manual check of the status")
-	}
+	return "", fmt.Errorf("Account Creation took too long to complete. Run resume to continue once it is done")
+}
 
-	log.Printf("INFO: Moving account %s from root to %s", acc.Alias, acc.root)
-	if acc.root != "" {
-		moveAccountInput := &organizations.MoveAccountInput{
-			AccountId:           aws.String(acc.ID),
-			DestinationParentId: aws.String(OrganizationUnitID),
-			SourceParentId:      aws.String(ParentID),
+// moveAccount moves an account, retrying with an exponential backoff when the move fails.
+func moveAccount(orgC organizationsiface.OrganizationsAPI, accountID, srcParentID, dstParentID string) error {
+	var err error
+	backoff := moveAccountBackoff
+	for i := 0; i < moveAccountAttempts; i++ {
+		if i > 0 {
+			log.Printf("INFO: Retrying to move account %s in %s after: %v", accountID, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
 		}
-
-		// TODO: Handle the case when account creation is succeeded but moving is failed
-		_, err := orgC.MoveAccount(moveAccountInput)
-		if err != nil {
-			return fmt.Errorf("ERROR: Failed to move the account %s to the destination organizational unit %s", acc.Alias, acc.root)
+		_, err = orgC.MoveAccount(&organizations.MoveAccountInput{
+			AccountId:           aws.String(accountID),
+			DestinationParentId: aws.String(dstParentID),
+			SourceParentId:      aws.String(srcParentID),
+		})
+		if err == nil {
+			return nil
 		}
 	}
-	content, err := ioutil.ReadFile("policies/template_policy.json")
-	if err != nil {
-		fmt.Errorf("ERROR: Failed to read the policy template with: %v", err)
-	}
-	dstFile := "policies/" + strings.Title(acc.Alias) + "-Policies"
-	err = ioutil.WriteFile(dstFile, content, 0644)
-	if err != nil {
-		fmt.Errorf("ERROR: Failed to create new policy template file with: %v", err)
-	}
-	acc.TemplateFile = dstFile
-	updateOrgYaml(acc)
-	err = UpdatePolicies([]string{acc.Alias}, true)
 	return err
-
 }
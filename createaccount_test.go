@@ -0,0 +1,179 @@
+package main
+
+import (
+	"github.com/annemakhil/org-governor/fakeaws"
+	"github.com/aws/aws-sdk-go/aws"
+	cfm "github.com/aws/aws-sdk-go/service/cloudformation"
+	"os"
+	"strings"
+	"testing"
+)
+
+// setupIdentityAccount adds the identity hub account with its policy stack to the fake organization.
+func setupIdentityAccount(t *testing.T, fake *fakeClients) Account {
+	t.Helper()
+	id := fake.org.AddAccount(fake.org.RootID(), "identity", "iam@example.com")
+	acc := Account{ID: id, Alias: "identity", Email: "iam@example.com", TemplateFile: writeTemplate(t, "Identity-Policies"), Role: roleIdentityHub}
+	fake.account(id).PutStack(fakeStack("Identity-Policies", &cfm.Parameter{ParameterKey: aws.String("Developers"), ParameterValue: aws.String("arn:aws:iam::1:role/existing")}))
+	return acc
+}
+
+func fakeStack(name string, params ...*cfm.Parameter) fakeaws.Stack {
+	return fakeaws.Stack{Name: name, Status: cfm.StackStatusCreateComplete, Parameters: params}
+}
+
+func TestCreateAccount(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	workloads := fake.org.AddOU(fake.org.RootID(), "Workloads")
+	prod := fake.org.AddOU(workloads, "Prod")
+	writeOrgYaml(Organization{
+		Accounts: []Account{iam},
+		OrganizationalUnits: []OrganizationalUnit{{ID: workloads, Name: "Workloads", OrganizationalUnits: []OrganizationalUnit{
+			{ID: prod, Name: "Prod"},
+		}}},
+	})
+	fake.org.CreateAccountPolls = 2
+
+	err := CreateAccount(testConfig, Account{Alias: "data", Email: "data@example.com", root: "Prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := loadLiveOrganization(fake.org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	la, parent := live.findAccount("", "data")
+	if la == nil || parent != prod {
+		t.Fatalf("account = %v in %s, want it in %s", la, parent, prod)
+	}
+	ou := findOrganizationalUnit(readOrgYaml().OrganizationalUnits, "Workloads/Prod")
+	if len(ou.Accounts) != 1 || ou.Accounts[0].ID != *la.Id || ou.Accounts[0].TemplateFile != "" {
+		t.Errorf("organization.yaml accounts of Workloads/Prod = %+v", ou.Accounts)
+	}
+	if _, err := os.Stat("policies/Data-Policies"); !os.IsNotExist(err) {
+		t.Errorf("the policy template was copied for the account, %v", err)
+	}
+	if s := fake.account(*la.Id).Stack("Data-Policies"); s == nil || s.Status != cfm.StackStatusCreateComplete {
+		t.Errorf("policy stack = %+v", s)
+	}
+}
+
+func TestCreateAccountOUNotInYaml(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	workloads := fake.org.AddOU(fake.org.RootID(), "Workloads")
+	prod := fake.org.AddOU(workloads, "Prod")
+	writeOrgYaml(Organization{Accounts: []Account{iam}})
+
+	if err := CreateAccount(testConfig, Account{Alias: "data", Email: "data@example.com", root: "Prod"}); err != nil {
+		t.Fatal(err)
+	}
+	ou := findOrganizationalUnit(readOrgYaml().OrganizationalUnits, "Workloads/Prod")
+	if ou == nil || len(ou.Accounts) != 1 || ou.Accounts[0].Alias != "data" {
+		t.Fatalf("organization.yaml Workloads/Prod = %+v", ou)
+	}
+	if fake.org.ParentOf(ou.Accounts[0].ID) != prod {
+		t.Errorf("account is in %s, want %s", fake.org.ParentOf(ou.Accounts[0].ID), prod)
+	}
+	if s := fake.account(ou.Accounts[0].ID).Stack("Data-Policies"); s == nil || s.Status != cfm.StackStatusCreateComplete {
+		t.Errorf("policy stack = %+v", s)
+	}
+}
+
+func TestCreateAccountExisting(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	fake.org.AddAccount(fake.org.RootID(), "data", "data@example.com")
+	err := CreateAccount(testConfig, Account{Alias: "data", Email: "other@example.com"})
+	if err == nil || !strings.Contains(err.Error(), "already existed") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestCreateAccountFailure(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	fake.org.CreateAccountFailure = "EMAIL_ALREADY_EXISTS"
+	err := CreateAccount(testConfig, Account{Alias: "data", Email: "data@example.com"})
+	if err == nil || !strings.Contains(err.Error(), "EMAIL_ALREADY_EXISTS") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestCreateAccountPendingMoveOUNotInYaml(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	prod := fake.org.AddOU(fake.org.RootID(), "Prod")
+	writeOrgYaml(Organization{Accounts: []Account{iam}})
+	fake.org.MoveAccountFailures = moveAccountAttempts
+
+	err := CreateAccount(testConfig, Account{Alias: "data", Email: "data@example.com", root: "Prod"})
+	if err == nil || !strings.Contains(err.Error(), accountStatePendingMove) {
+		t.Fatalf("err = %v", err)
+	}
+	ou := findOrganizationalUnit(readOrgYaml().OrganizationalUnits, "Prod")
+	if ou == nil || len(ou.Accounts) != 1 || ou.Accounts[0].State != accountStatePendingMove || ou.Accounts[0].ID == "" {
+		t.Fatalf("organization.yaml Prod = %+v", ou)
+	}
+	if err := Apply(nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.org.ParentOf(ou.Accounts[0].ID) != prod {
+		t.Errorf("account is in %s after apply, want %s", fake.org.ParentOf(ou.Accounts[0].ID), prod)
+	}
+}
+
+func TestCreateAccountThrottled(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	writeOrgYaml(Organization{Accounts: []Account{iam}})
+	fake.org.DescribeCreateAccountStatusFailures = 1
+
+	err := CreateAccount(testConfig, Account{Alias: "data", Email: "data@example.com"})
+	if err == nil || !strings.Contains(err.Error(), "run resume") {
+		t.Fatalf("err = %v", err)
+	}
+	if entries := readJournal(); len(entries) != 1 || entries[0].Step != stepRequested {
+		t.Fatalf("journal = %+v", entries)
+	}
+	if err := Resume(testConfig); err != nil {
+		t.Fatal(err)
+	}
+	if entries := readJournal(); entries[0].Step != stepPoliciesApplied {
+		t.Errorf("journal = %+v", entries)
+	}
+}
+
+func TestCreateAccountPendingMove(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	prod := fake.org.AddOU(fake.org.RootID(), "Prod")
+	writeOrgYaml(Organization{Accounts: []Account{iam}, OrganizationalUnits: []OrganizationalUnit{{ID: prod, Name: "Prod"}}})
+	fake.org.MoveAccountFailures = moveAccountAttempts + 1
+
+	err := CreateAccount(testConfig, Account{Alias: "data", Email: "data@example.com", root: "Prod"})
+	if err == nil || !strings.Contains(err.Error(), accountStatePendingMove) {
+		t.Fatalf("err = %v", err)
+	}
+	ou := findOrganizationalUnit(readOrgYaml().OrganizationalUnits, "Prod")
+	if len(ou.Accounts) != 1 || ou.Accounts[0].State != accountStatePendingMove || ou.Accounts[0].ID == "" {
+		t.Fatalf("organization.yaml Prod = %+v", ou)
+	}
+
+	// apply retries past the remaining failure and clears the state.
+	if err := Apply(nil); err != nil {
+		t.Fatal(err)
+	}
+	ou = findOrganizationalUnit(readOrgYaml().OrganizationalUnits, "Prod")
+	if fake.org.ParentOf(ou.Accounts[0].ID) != prod || ou.Accounts[0].State != "" {
+		t.Errorf("account %+v in %s after apply", ou.Accounts[0], fake.org.ParentOf(ou.Accounts[0].ID))
+	}
+
+	// resume finishes the remaining steps.
+	if err := Resume(testConfig); err != nil {
+		t.Fatal(err)
+	}
+	if entries := readJournal(); entries[0].Step != stepPoliciesApplied {
+		t.Errorf("journal = %+v", entries)
+	}
+}
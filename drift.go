@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	cli "github.com/urfave/cli/v2"
+	"log"
+	"strings"
+)
+
+const (
+	driftExitCode = 2
+
+	driftAccountNotInYaml = "account-not-in-yaml"
+	driftAccountNotInAws  = "account-not-in-aws"
+	driftAccountID        = "account-id-mismatch"
+	driftAccountEmail     = "account-email-mismatch"
+	driftAccountName      = "account-name-mismatch"
+	driftAccountPlacement = "account-misplaced"
+	driftOUNotInYaml      = "ou-not-in-yaml"
+	driftOUNotInAws       = "ou-not-in-aws"
+	driftOUStaleID        = "ou-stale-id"
+)
+
+// driftFinding is a difference between organization.yaml and the live organization.
+type driftFinding struct {
+	Kind    string
+	Message string
+}
+
+func (f driftFinding) String() string {
+	return fmt.Sprintf("%-24s %s", f.Kind, f.Message)
+}
+
+// detectDrift compares organization.yaml with the live organization.
+func detectDrift(org Organization, live *liveOrganization) []driftFinding {
+	var findings []driftFinding
+	report := func(kind, format string, args ...interface{}) {
+		findings = append(findings, driftFinding{Kind: kind, Message: fmt.Sprintf(format, args...)})
+	}
+
+	type placedAccount struct {
+		account *organizations.Account
+		path    string
+	}
+	livePaths := live.paths()
+	byID := make(map[string]placedAccount)
+	byName := make(map[string]placedAccount)
+	ouByID := make(map[string]string)
+	for path, u := range livePaths {
+		ouByID[u.ID] = path
+		for _, a := range u.Accounts {
+			byID[*a.Id] = placedAccount{a, path}
+			byName[*a.Name] = placedAccount{a, path}
+		}
+	}
+
+	seen := make(map[string]bool)
+	checkAccounts := func(path string, accounts []Account) {
+		for _, acc := range accounts {
+			la, ok := byID[acc.ID]
+			if acc.ID == "" || !ok {
+				named, found := byName[acc.Alias]
+				if !found {
+					report(driftAccountNotInAws, "%s (%s) in %s is not in the organization", acc.Alias, acc.ID, displayOUPath(path))
+					continue
+				}
+				report(driftAccountID, "%s has ID %q in organization.yaml but %s in AWS", acc.Alias, acc.ID, *named.account.Id)
+				la = named
+			}
+			seen[*la.account.Id] = true
+			if *la.account.Name != acc.Alias {
+				report(driftAccountName, "%s is named %s in AWS", acc.Alias, *la.account.Name)
+			}
+			if !strings.EqualFold(*la.account.Email, acc.Email) {
+				report(driftAccountEmail, "%s has email %s in organization.yaml but %s in AWS", acc.Alias, acc.Email, *la.account.Email)
+			}
+			if la.path != path {
+				report(driftAccountPlacement, "%s is in %s but organization.yaml places it in %s", acc.Alias, displayOUPath(la.path), displayOUPath(path))
+			}
+		}
+	}
+
+	checkAccounts("", org.Accounts)
+	yamlPaths := make(map[string]bool)
+	walkOrganizationalUnits(org.OrganizationalUnits, "", func(path string, ou *OrganizationalUnit) {
+		yamlPaths[path] = true
+		lou := livePaths[path]
+		switch {
+		case lou == nil && ou.ID != "" && ouByID[ou.ID] != "":
+			report(driftOUStaleID, "%s (%s) is %s in AWS", path, ou.ID, ouByID[ou.ID])
+		case lou == nil:
+			report(driftOUNotInAws, "%s (%s) is not in the organization", path, ou.ID)
+		case ou.ID != "" && lou.ID != ou.ID:
+			report(driftOUStaleID, "%s has ID %s in organization.yaml but %s in AWS", path, ou.ID, lou.ID)
+		}
+		checkAccounts(path, ou.Accounts)
+	})
+
+	walkLive(live.Root, "", func(path string, u *liveOU) {
+		if path != "" && !yamlPaths[path] {
+			report(driftOUNotInYaml, "%s (%s) is not in organization.yaml", path, u.ID)
+		}
+		for _, a := range u.Accounts {
+			if !seen[*a.Id] {
+				report(driftAccountNotInYaml, "%s (%s) in %s is not in organization.yaml", *a.Name, *a.Id, displayOUPath(path))
+			}
+		}
+	})
+	return findings
+}
+
+// Drift reports the differences between organization.yaml and the live organization.
+// It exits with a non-zero code when drift is found.
+func Drift(ctx *cli.Context) error {
+	org := readOrgYaml()
+	orgC := makeOrgClient(profile, orgRole)
+	live, err := loadLiveOrganization(orgC)
+	if err != nil {
+		return err
+	}
+	findings := detectDrift(org, live)
+	if len(findings) == 0 {
+		log.Println("INFO: No drift detected")
+		return nil
+	}
+	for _, f := range findings {
+		fmt.Println(f)
+	}
+	return cli.Exit(fmt.Sprintf("ERROR: %d drift(s) detected between organization.yaml and the organization", len(findings)), driftExitCode)
+}
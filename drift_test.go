@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDetectDrift(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	workloads := fake.org.AddOU(fake.org.RootID(), "Workloads")
+	prod := fake.org.AddOU(workloads, "Prod")
+	data := fake.org.AddAccount(prod, "data", "data@example.com")
+	moved := fake.org.AddAccount(fake.org.RootID(), "moved", "moved@example.com")
+	fake.org.AddAccount(workloads, "unknown", "unknown@example.com")
+	fake.org.RenameOU(prod, "Production")
+
+	org := Organization{OrganizationalUnits: []OrganizationalUnit{{
+		ID:   workloads,
+		Name: "Workloads",
+		Accounts: []Account{
+			{ID: moved, Alias: "moved", Email: "moved@example.com"},
+			{ID: "999999999999", Alias: "gone", Email: "gone@example.com"},
+		},
+		OrganizationalUnits: []OrganizationalUnit{{
+			ID:       prod,
+			Name:     "Prod",
+			Accounts: []Account{{ID: data, Alias: "data", Email: "changed@example.com"}},
+		}},
+	}}}
+	live, err := loadLiveOrganization(fake.org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[string]int{}
+	for _, f := range detectDrift(org, live) {
+		kinds[f.Kind]++
+	}
+	want := map[string]int{
+		driftAccountPlacement: 2, // moved is in the root, data is in Workloads/Production
+		driftAccountNotInAws:  1,
+		driftAccountEmail:     1,
+		driftAccountNotInYaml: 1,
+		driftOUStaleID:        1,
+		driftOUNotInYaml:      1,
+	}
+	for k, n := range want {
+		if kinds[k] != n {
+			t.Errorf("%s findings = %d, want %d (all: %v)", k, kinds[k], n, kinds)
+		}
+	}
+	if len(kinds) != len(want) {
+		t.Errorf("findings = %v, want %v", kinds, want)
+	}
+
+	if findings := detectDrift(importOrganization(live, Organization{}), live); len(findings) != 0 {
+		t.Errorf("drift of an imported organization = %v", findings)
+	}
+}
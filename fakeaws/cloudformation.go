@@ -0,0 +1,454 @@
+package fakeaws
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stack is the state of a stack in the fake CloudFormation backend.
+type Stack struct {
+	Name         string
+	Status       string
+	TemplateURL  string
+	TemplateBody string
+	Parameters   []*cloudformation.Parameter
+	Outputs      []*cloudformation.Output
+	Tags         []*cloudformation.Tag
+	// NextStatuses are the statuses the stack goes through, one per DescribeStacks call.
+	NextStatuses []string
+}
+
+// Failure makes the execution of the change sets of a stack fail on a resource, the stack is
+// rolled back.
+type Failure struct {
+	LogicalID    string
+	ResourceType string
+	Reason       string
+}
+
+type changeSet struct {
+	id, stackName, changeSetType string
+	status, reason               string
+	templateURL, templateBody    string
+	parameters                   []*cloudformation.Parameter
+	tags                         []*cloudformation.Tag
+	changes                      []*cloudformation.Change
+}
+
+// CloudFormation is an in-memory CloudFormation backend for a single account and region.
+// Change sets complete immediately and stack operations only fail through Failures.
+// Calls that are not implemented panic through the embedded nil interface.
+type CloudFormation struct {
+	cloudformationiface.CloudFormationAPI
+
+	// Outputs are the outputs a stack reports once it is created, by stack name.
+	Outputs map[string][]*cloudformation.Output
+	// Changes are the resource changes reported by the change sets of a stack, by stack name.
+	Changes map[string][]*cloudformation.Change
+	// Failures make the execution of the change sets of a stack fail, by stack name.
+	Failures map[string]Failure
+	// EventPageSize limits the number of events returned by each DescribeStackEvents call.
+	// Zero returns everything.
+	EventPageSize int
+
+	mu         sync.Mutex
+	nextID     int
+	stacks     map[string]*Stack
+	changeSets map[string]*changeSet
+	events     map[string][]*cloudformation.StackEvent
+}
+
+// NewCloudFormation returns a backend without any stack.
+func NewCloudFormation() *CloudFormation {
+	return &CloudFormation{
+		Outputs:    make(map[string][]*cloudformation.Output),
+		Changes:    make(map[string][]*cloudformation.Change),
+		Failures:   make(map[string]Failure),
+		events:     make(map[string][]*cloudformation.StackEvent),
+		stacks:     make(map[string]*Stack),
+		changeSets: make(map[string]*changeSet),
+	}
+}
+
+// Stack returns a copy of the named stack, or nil.
+func (c *CloudFormation) Stack(name string) *Stack {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.stacks[name]
+	if !ok {
+		return nil
+	}
+	cp := *s
+	return &cp
+}
+
+// PutStack creates or replaces a stack directly in the backend.
+func (c *CloudFormation) PutStack(s Stack) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stacks[s.Name] = &s
+}
+
+// event records an event of a stack, logicalID is the stack name for the events of the stack itself.
+func (c *CloudFormation) event(stackName, logicalID, resourceType, status, reason string) {
+	c.nextID++
+	e := &cloudformation.StackEvent{
+		EventId:           aws.String(fmt.Sprintf("event-%d", c.nextID)),
+		StackName:         aws.String(stackName),
+		LogicalResourceId: aws.String(logicalID),
+		ResourceType:      aws.String(resourceType),
+		ResourceStatus:    aws.String(status),
+		Timestamp:         aws.Time(time.Now()),
+	}
+	if reason != "" {
+		e.ResourceStatusReason = aws.String(reason)
+	}
+	c.events[stackName] = append(c.events[stackName], e)
+}
+
+func notFound(name string) error {
+	return awserr.New("ValidationError", fmt.Sprintf("Stack with id %s does not exist", name), nil)
+}
+
+// resolveParameters replaces the parameters passed with UsePreviousValue by the value of the
+// stack. Like CloudFormation, it fails when the stack has no such parameter.
+func resolveParameters(previous, params []*cloudformation.Parameter) ([]*cloudformation.Parameter, error) {
+	if params == nil {
+		return nil, nil
+	}
+	resolved := make([]*cloudformation.Parameter, 0, len(params))
+	for _, p := range params {
+		if !aws.BoolValue(p.UsePreviousValue) {
+			resolved = append(resolved, p)
+			continue
+		}
+		found := false
+		for _, prev := range previous {
+			if aws.StringValue(prev.ParameterKey) == aws.StringValue(p.ParameterKey) {
+				resolved = append(resolved, &cloudformation.Parameter{ParameterKey: prev.ParameterKey, ParameterValue: prev.ParameterValue})
+				found = true
+			}
+		}
+		if !found {
+			return nil, awserr.New("ValidationError", "Parameter "+aws.StringValue(p.ParameterKey)+" has no previous value", nil)
+		}
+	}
+	return resolved, nil
+}
+
+func (c *CloudFormation) describe(s *Stack) *cloudformation.Stack {
+	return &cloudformation.Stack{
+		StackName:   aws.String(s.Name),
+		StackId:     aws.String("arn:aws:cloudformation:stack/" + s.Name),
+		StackStatus: aws.String(s.Status),
+		Parameters:  s.Parameters,
+		Outputs:     s.Outputs,
+		Tags:        s.Tags,
+	}
+}
+
+// DescribeStacks describes the named stack.
+func (c *CloudFormation) DescribeStacks(in *cloudformation.DescribeStacksInput) (*cloudformation.DescribeStacksOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.stacks[aws.StringValue(in.StackName)]
+	if !ok {
+		return nil, notFound(aws.StringValue(in.StackName))
+	}
+	if len(s.NextStatuses) > 0 {
+		s.Status, s.NextStatuses = s.NextStatuses[0], s.NextStatuses[1:]
+	}
+	return &cloudformation.DescribeStacksOutput{Stacks: []*cloudformation.Stack{c.describe(s)}}, nil
+}
+
+// CreateChangeSet creates a change set that is complete right away. It fails with
+// "didn't contain changes" when the template and parameters match the stack.
+func (c *CloudFormation) CreateChangeSet(in *cloudformation.CreateChangeSetInput) (*cloudformation.CreateChangeSetOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := aws.StringValue(in.StackName)
+	s, exists := c.stacks[name]
+	switch aws.StringValue(in.ChangeSetType) {
+	case cloudformation.ChangeSetTypeCreate:
+		if exists && s.Status != cloudformation.StackStatusReviewInProgress {
+			return nil, awserr.New(cloudformation.ErrCodeAlreadyExistsException, "Stack ["+name+"] already exists", nil)
+		}
+	default:
+		if !exists {
+			return nil, notFound(name)
+		}
+	}
+	var previous []*cloudformation.Parameter
+	if exists {
+		previous = s.Parameters
+	}
+	params, err := resolveParameters(previous, in.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	c.nextID++
+	cs := &changeSet{
+		id:            fmt.Sprintf("arn:aws:cloudformation:changeSet/%s/%d", aws.StringValue(in.ChangeSetName), c.nextID),
+		stackName:     name,
+		changeSetType: aws.StringValue(in.ChangeSetType),
+		status:        cloudformation.ChangeSetStatusCreateComplete,
+		templateURL:   aws.StringValue(in.TemplateURL),
+		templateBody:  aws.StringValue(in.TemplateBody),
+		parameters:    params,
+		tags:          in.Tags,
+	}
+	if exists && s.Status != cloudformation.StackStatusReviewInProgress && sameTemplate(s.TemplateURL, cs.templateURL) && s.TemplateBody == cs.templateBody && reflect.DeepEqual(s.Parameters, cs.parameters) {
+		cs.status = cloudformation.ChangeSetStatusFailed
+		cs.reason = "The submitted information didn't contain changes. Submit different information to create a change set."
+	} else {
+		cs.changes = c.Changes[name]
+	}
+	if !exists {
+		c.stacks[name] = &Stack{Name: name, Status: cloudformation.StackStatusReviewInProgress}
+		c.event(name, name, "AWS::CloudFormation::Stack", cloudformation.StackStatusReviewInProgress, "User Initiated")
+	}
+	c.changeSets[cs.id] = cs
+	return &cloudformation.CreateChangeSetOutput{Id: aws.String(cs.id), StackId: aws.String("arn:aws:cloudformation:stack/" + name)}, nil
+}
+
+func (c *CloudFormation) changeSet(name *string) (*changeSet, error) {
+	cs, ok := c.changeSets[aws.StringValue(name)]
+	if !ok {
+		return nil, awserr.New(cloudformation.ErrCodeChangeSetNotFoundException, "ChangeSet ["+aws.StringValue(name)+"] does not exist", nil)
+	}
+	return cs, nil
+}
+
+// DescribeChangeSet describes a change set created by CreateChangeSet.
+func (c *CloudFormation) DescribeChangeSet(in *cloudformation.DescribeChangeSetInput) (*cloudformation.DescribeChangeSetOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cs, err := c.changeSet(in.ChangeSetName)
+	if err != nil {
+		return nil, err
+	}
+	out := &cloudformation.DescribeChangeSetOutput{
+		ChangeSetId: aws.String(cs.id),
+		StackName:   aws.String(cs.stackName),
+		Status:      aws.String(cs.status),
+		Parameters:  cs.parameters,
+		Changes:     cs.changes,
+	}
+	if cs.reason != "" {
+		out.StatusReason = aws.String(cs.reason)
+	}
+	return out, nil
+}
+
+// WaitUntilChangeSetCreateComplete fails like the SDK waiter when the change set failed.
+func (c *CloudFormation) WaitUntilChangeSetCreateComplete(in *cloudformation.DescribeChangeSetInput) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cs, err := c.changeSet(in.ChangeSetName)
+	if err != nil {
+		return err
+	}
+	if cs.status == cloudformation.ChangeSetStatusFailed {
+		return awserr.New("ResourceNotReady", "failed waiting for successful resource state", nil)
+	}
+	return nil
+}
+
+// ExecuteChangeSet applies a change set to its stack.
+func (c *CloudFormation) ExecuteChangeSet(in *cloudformation.ExecuteChangeSetInput) (*cloudformation.ExecuteChangeSetOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cs, err := c.changeSet(in.ChangeSetName)
+	if err != nil {
+		return nil, err
+	}
+	if cs.status != cloudformation.ChangeSetStatusCreateComplete {
+		return nil, awserr.New(cloudformation.ErrCodeInvalidChangeSetStatusException, "ChangeSet is in "+cs.status+" status", nil)
+	}
+	s := c.stacks[cs.stackName]
+	delete(c.changeSets, cs.id)
+	create := cs.changeSetType == cloudformation.ChangeSetTypeCreate
+	operation, stackType := "UPDATE", "AWS::CloudFormation::Stack"
+	if create {
+		operation = "CREATE"
+	}
+	c.event(s.Name, s.Name, stackType, operation+"_IN_PROGRESS", "User Initiated")
+	if f, ok := c.Failures[s.Name]; ok {
+		c.event(s.Name, f.LogicalID, f.ResourceType, operation+"_IN_PROGRESS", "")
+		c.event(s.Name, f.LogicalID, f.ResourceType, operation+"_FAILED", f.Reason)
+		s.Status = cloudformation.StackStatusUpdateRollbackComplete
+		if create {
+			s.Status = cloudformation.StackStatusRollbackComplete
+		}
+		c.event(s.Name, s.Name, stackType, s.Status, "")
+		return &cloudformation.ExecuteChangeSetOutput{}, nil
+	}
+	for _, change := range cs.changes {
+		if rc := change.ResourceChange; rc != nil {
+			c.event(s.Name, aws.StringValue(rc.LogicalResourceId), aws.StringValue(rc.ResourceType), operation+"_IN_PROGRESS", "")
+			c.event(s.Name, aws.StringValue(rc.LogicalResourceId), aws.StringValue(rc.ResourceType), operation+"_COMPLETE", "")
+		}
+	}
+	s.TemplateURL, s.TemplateBody, s.Parameters, s.Tags = cs.templateURL, cs.templateBody, cs.parameters, cs.tags
+	if create {
+		s.Status = cloudformation.StackStatusCreateComplete
+		s.Outputs = c.Outputs[cs.stackName]
+	} else {
+		s.Status = cloudformation.StackStatusUpdateComplete
+	}
+	c.event(s.Name, s.Name, stackType, s.Status, "")
+	return &cloudformation.ExecuteChangeSetOutput{}, nil
+}
+
+// DescribeStackEvents returns the events of a stack, the most recent first.
+func (c *CloudFormation) DescribeStackEvents(in *cloudformation.DescribeStackEventsInput) (*cloudformation.DescribeStackEventsOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := aws.StringValue(in.StackName)
+	if _, ok := c.stacks[name]; !ok {
+		return nil, notFound(name)
+	}
+	events := c.events[name]
+	start := 0
+	if in.NextToken != nil {
+		start, _ = strconv.Atoi(*in.NextToken)
+	}
+	out := &cloudformation.DescribeStackEventsOutput{}
+	for i := len(events) - 1 - start; i >= 0; i-- {
+		if c.EventPageSize > 0 && len(out.StackEvents) == c.EventPageSize {
+			out.NextToken = aws.String(strconv.Itoa(start + c.EventPageSize))
+			break
+		}
+		out.StackEvents = append(out.StackEvents, events[i])
+	}
+	return out, nil
+}
+
+// DescribeStackEventsPages calls fn for every page of DescribeStackEvents.
+func (c *CloudFormation) DescribeStackEventsPages(in *cloudformation.DescribeStackEventsInput, fn func(*cloudformation.DescribeStackEventsOutput, bool) bool) error {
+	input := *in
+	for {
+		out, err := c.DescribeStackEvents(&input)
+		if err != nil {
+			return err
+		}
+		if !fn(out, out.NextToken == nil) || out.NextToken == nil {
+			return nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// DeleteChangeSet deletes a change set without executing it.
+func (c *CloudFormation) DeleteChangeSet(in *cloudformation.DeleteChangeSetInput) (*cloudformation.DeleteChangeSetOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cs, err := c.changeSet(in.ChangeSetName)
+	if err != nil {
+		return nil, err
+	}
+	delete(c.changeSets, cs.id)
+	return &cloudformation.DeleteChangeSetOutput{}, nil
+}
+
+// DeleteStack deletes a stack and its change sets right away.
+func (c *CloudFormation) DeleteStack(in *cloudformation.DeleteStackInput) (*cloudformation.DeleteStackOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := aws.StringValue(in.StackName)
+	delete(c.stacks, name)
+	delete(c.events, name)
+	for id, cs := range c.changeSets {
+		if cs.stackName == name {
+			delete(c.changeSets, id)
+		}
+	}
+	return &cloudformation.DeleteStackOutput{}, nil
+}
+
+// ContinueUpdateRollback completes the rollback of a stack in UPDATE_ROLLBACK_FAILED.
+func (c *CloudFormation) ContinueUpdateRollback(in *cloudformation.ContinueUpdateRollbackInput) (*cloudformation.ContinueUpdateRollbackOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.stacks[aws.StringValue(in.StackName)]
+	if !ok {
+		return nil, notFound(aws.StringValue(in.StackName))
+	}
+	if s.Status != cloudformation.StackStatusUpdateRollbackFailed {
+		return nil, awserr.New("ValidationError", "Stack is in "+s.Status+" state and can not continue the rollback", nil)
+	}
+	s.Status = cloudformation.StackStatusUpdateRollbackComplete
+	return &cloudformation.ContinueUpdateRollbackOutput{}, nil
+}
+
+// UpdateStack updates a stack directly.
+func (c *CloudFormation) UpdateStack(in *cloudformation.UpdateStackInput) (*cloudformation.UpdateStackOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.stacks[aws.StringValue(in.StackName)]
+	if !ok {
+		return nil, notFound(aws.StringValue(in.StackName))
+	}
+	params, err := resolveParameters(s.Parameters, in.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	if sameTemplate(s.TemplateURL, aws.StringValue(in.TemplateURL)) && s.TemplateBody == aws.StringValue(in.TemplateBody) && reflect.DeepEqual(s.Parameters, params) {
+		return nil, awserr.New("ValidationError", "No updates are to be performed.", nil)
+	}
+	s.TemplateURL, s.TemplateBody, s.Parameters = aws.StringValue(in.TemplateURL), aws.StringValue(in.TemplateBody), params
+	if in.Tags != nil {
+		s.Tags = in.Tags
+	}
+	c.event(s.Name, s.Name, "AWS::CloudFormation::Stack", cloudformation.StackStatusUpdateInProgress, "User Initiated")
+	s.Status = cloudformation.StackStatusUpdateComplete
+	c.event(s.Name, s.Name, "AWS::CloudFormation::Stack", s.Status, "")
+	return &cloudformation.UpdateStackOutput{StackId: aws.String("arn:aws:cloudformation:stack/" + s.Name)}, nil
+}
+
+func (c *CloudFormation) waitUntil(name *string, statuses ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.stacks[aws.StringValue(name)]
+	if !ok {
+		return notFound(aws.StringValue(name))
+	}
+	for _, status := range statuses {
+		if s.Status == status {
+			return nil
+		}
+	}
+	return awserr.New("ResourceNotReady", "failed waiting for successful resource state", nil)
+}
+
+// WaitUntilStackCreateComplete succeeds when the stack is CREATE_COMPLETE.
+func (c *CloudFormation) WaitUntilStackCreateComplete(in *cloudformation.DescribeStacksInput) error {
+	return c.waitUntil(in.StackName, cloudformation.StackStatusCreateComplete)
+}
+
+// WaitUntilStackUpdateComplete succeeds when the stack is UPDATE_COMPLETE.
+func (c *CloudFormation) WaitUntilStackUpdateComplete(in *cloudformation.DescribeStacksInput) error {
+	return c.waitUntil(in.StackName, cloudformation.StackStatusUpdateComplete)
+}
+
+// sameTemplate reports whether two template URLs point to the same template. The query, like the
+// signature of a presigned URL, is ignored, CloudFormation compares the templates themselves.
+func sameTemplate(a, b string) bool {
+	return strings.SplitN(a, "?", 2)[0] == strings.SplitN(b, "?", 2)[0]
+}
+
+// ValidateTemplate only checks that an inline template declares its Resources.
+func (c *CloudFormation) ValidateTemplate(in *cloudformation.ValidateTemplateInput) (*cloudformation.ValidateTemplateOutput, error) {
+	if !strings.Contains(aws.StringValue(in.TemplateBody), "Resources") {
+		return nil, awserr.New("ValidationError", "Template format error: At least one Resources member must be defined.", nil)
+	}
+	return &cloudformation.ValidateTemplateOutput{}, nil
+}
@@ -0,0 +1,396 @@
+// Package fakeaws provides in-memory fakes of the AWS services used by the governor,
+// so the commands can be exercised without a real AWS organization.
+package fakeaws
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// OrganizationID is the ID of the fake organization.
+const OrganizationID = "o-fake"
+
+type createRequest struct {
+	name, email string
+	polls       int
+	status      *organizations.CreateAccountStatus
+}
+
+// Organizations is an in-memory AWS Organizations backend with a single root.
+// Calls that are not implemented panic through the embedded nil interface.
+type Organizations struct {
+	organizationsiface.OrganizationsAPI
+
+	// PageSize limits the number of items returned by each list call. Zero returns everything.
+	PageSize int
+	// CreateAccountPolls is how many times DescribeCreateAccountStatus reports IN_PROGRESS
+	// before a new account is created.
+	CreateAccountPolls int
+	// CreateAccountFailure, when set, is the failure reason reported for new accounts.
+	CreateAccountFailure string
+	// DescribeCreateAccountStatusFailures is how many of the next DescribeCreateAccountStatus calls
+	// fail with a throttling error.
+	DescribeCreateAccountStatusFailures int
+	// MoveAccountFailures is how many of the next MoveAccount calls fail with a concurrent modification error.
+	MoveAccountFailures int
+
+	mu       sync.Mutex
+	nextID   int
+	root     *organizations.Root
+	ous      map[string]*organizations.OrganizationalUnit
+	accounts map[string]*organizations.Account
+	parents  map[string]string
+	order    map[string]int
+	requests map[string]*createRequest
+	policies map[string]*policy
+}
+
+// NewOrganizations returns an organization that only has its root, with FullAWSAccess attached.
+func NewOrganizations() *Organizations {
+	return &Organizations{
+		root:     &organizations.Root{Id: aws.String("r-root"), Name: aws.String("Root")},
+		ous:      make(map[string]*organizations.OrganizationalUnit),
+		accounts: make(map[string]*organizations.Account),
+		parents:  make(map[string]string),
+		order:    make(map[string]int),
+		requests: make(map[string]*createRequest),
+		policies: map[string]*policy{fullAWSAccessID: {
+			summary: &organizations.PolicySummary{
+				Id:          aws.String(fullAWSAccessID),
+				Name:        aws.String("FullAWSAccess"),
+				Description: aws.String("Allows access to every operation"),
+				Type:        aws.String(organizations.PolicyTypeServiceControlPolicy),
+				AwsManaged:  aws.Bool(true),
+			},
+			content: `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"*","Resource":"*"}]}`,
+			targets: map[string]bool{"r-root": true},
+		}},
+	}
+}
+
+// RootID returns the ID of the root.
+func (o *Organizations) RootID() string {
+	return *o.root.Id
+}
+
+// AddOU creates an organizational unit directly in the backend and returns its ID.
+func (o *Organizations) AddOU(parentID, name string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	out, err := o.createOU(parentID, name)
+	if err != nil {
+		panic(err)
+	}
+	return *out.Id
+}
+
+// AddAccount creates an account directly in the backend and returns its ID.
+func (o *Organizations) AddAccount(parentID, name, email string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return *o.createAccount(parentID, name, email).Id
+}
+
+// ParentOf returns the ID of the parent of an account or OU.
+func (o *Organizations) ParentOf(id string) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.parents[id]
+}
+
+// Account returns the account with the given ID, or nil.
+func (o *Organizations) Account(id string) *organizations.Account {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.accounts[id]
+}
+
+// RenameOU changes the name of an OU, like an edit in the console.
+func (o *Organizations) RenameOU(id, name string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.ous[id].Name = aws.String(name)
+}
+
+func (o *Organizations) id(prefix string) string {
+	o.nextID++
+	return fmt.Sprintf("%s%d", prefix, o.nextID)
+}
+
+func (o *Organizations) parentExists(id string) bool {
+	_, ok := o.ous[id]
+	return ok || id == *o.root.Id
+}
+
+func (o *Organizations) createOU(parentID, name string) (*organizations.OrganizationalUnit, error) {
+	if !o.parentExists(parentID) {
+		return nil, awserr.New(organizations.ErrCodeParentNotFoundException, "parent "+parentID+" not found", nil)
+	}
+	for id, p := range o.parents {
+		if u, ok := o.ous[id]; ok && p == parentID && *u.Name == name {
+			return nil, awserr.New(organizations.ErrCodeDuplicateOrganizationalUnitException, "duplicate organizational unit "+name, nil)
+		}
+	}
+	id := o.id("ou-root-")
+	ou := &organizations.OrganizationalUnit{Id: aws.String(id), Name: aws.String(name), Arn: aws.String("arn:aws:organizations::ou/" + id)}
+	o.ous[id] = ou
+	o.parents[id] = parentID
+	o.order[id] = o.nextID
+	return ou, nil
+}
+
+func (o *Organizations) createAccount(parentID, name, email string) *organizations.Account {
+	o.nextID++
+	id := strconv.Itoa(100000000000 + o.nextID)
+	acc := &organizations.Account{
+		Id:     aws.String(id),
+		Name:   aws.String(name),
+		Email:  aws.String(email),
+		Status: aws.String(organizations.AccountStatusActive),
+	}
+	o.accounts[id] = acc
+	o.parents[id] = parentID
+	o.order[id] = o.nextID
+	return acc
+}
+
+// children returns the IDs of the direct children of parentID accepted by isMember, in creation order.
+func (o *Organizations) children(parentID string, isMember func(id string) bool) []string {
+	var ids []string
+	for id, p := range o.parents {
+		if p == parentID && isMember(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return o.order[ids[i]] < o.order[ids[j]] })
+	return ids
+}
+
+// page returns the slice bounds of the page starting at token and the token of the next page.
+func (o *Organizations) page(n int, token *string) (int, int, *string) {
+	start := 0
+	if token != nil {
+		start, _ = strconv.Atoi(*token)
+	}
+	end := n
+	if o.PageSize > 0 && start+o.PageSize < n {
+		end = start + o.PageSize
+		return start, end, aws.String(strconv.Itoa(end))
+	}
+	return start, end, nil
+}
+
+func (o *Organizations) isOU(id string) bool {
+	_, ok := o.ous[id]
+	return ok
+}
+
+func (o *Organizations) isAccount(id string) bool {
+	_, ok := o.accounts[id]
+	return ok
+}
+
+// CreateOrganization fails because the fake organization always exists.
+func (o *Organizations) CreateOrganization(in *organizations.CreateOrganizationInput) (*organizations.CreateOrganizationOutput, error) {
+	return nil, awserr.New(organizations.ErrCodeAlreadyInOrganizationException, "the account is already a member of an organization", nil)
+}
+
+// DescribeOrganization returns the organization with the ID o-fake.
+func (o *Organizations) DescribeOrganization(in *organizations.DescribeOrganizationInput) (*organizations.DescribeOrganizationOutput, error) {
+	return &organizations.DescribeOrganizationOutput{Organization: &organizations.Organization{Id: aws.String(OrganizationID)}}, nil
+}
+
+// ListRoots returns the single root.
+func (o *Organizations) ListRoots(in *organizations.ListRootsInput) (*organizations.ListRootsOutput, error) {
+	return &organizations.ListRootsOutput{Roots: []*organizations.Root{o.root}}, nil
+}
+
+// ListOrganizationalUnitsForParent lists the OUs directly under a parent.
+func (o *Organizations) ListOrganizationalUnitsForParent(in *organizations.ListOrganizationalUnitsForParentInput) (*organizations.ListOrganizationalUnitsForParentOutput, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.parentExists(aws.StringValue(in.ParentId)) {
+		return nil, awserr.New(organizations.ErrCodeParentNotFoundException, "parent not found", nil)
+	}
+	ids := o.children(*in.ParentId, o.isOU)
+	start, end, next := o.page(len(ids), in.NextToken)
+	out := &organizations.ListOrganizationalUnitsForParentOutput{NextToken: next}
+	for _, id := range ids[start:end] {
+		out.OrganizationalUnits = append(out.OrganizationalUnits, o.ous[id])
+	}
+	return out, nil
+}
+
+// ListOrganizationalUnitsForParentPages calls fn for every page of ListOrganizationalUnitsForParent.
+func (o *Organizations) ListOrganizationalUnitsForParentPages(in *organizations.ListOrganizationalUnitsForParentInput, fn func(*organizations.ListOrganizationalUnitsForParentOutput, bool) bool) error {
+	input := *in
+	for {
+		out, err := o.ListOrganizationalUnitsForParent(&input)
+		if err != nil {
+			return err
+		}
+		if !fn(out, out.NextToken == nil) || out.NextToken == nil {
+			return nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// ListAccountsForParent lists the accounts directly under a parent.
+func (o *Organizations) ListAccountsForParent(in *organizations.ListAccountsForParentInput) (*organizations.ListAccountsForParentOutput, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.parentExists(aws.StringValue(in.ParentId)) {
+		return nil, awserr.New(organizations.ErrCodeParentNotFoundException, "parent not found", nil)
+	}
+	ids := o.children(*in.ParentId, o.isAccount)
+	start, end, next := o.page(len(ids), in.NextToken)
+	out := &organizations.ListAccountsForParentOutput{NextToken: next}
+	for _, id := range ids[start:end] {
+		out.Accounts = append(out.Accounts, o.accounts[id])
+	}
+	return out, nil
+}
+
+// ListAccountsForParentPages calls fn for every page of ListAccountsForParent.
+func (o *Organizations) ListAccountsForParentPages(in *organizations.ListAccountsForParentInput, fn func(*organizations.ListAccountsForParentOutput, bool) bool) error {
+	input := *in
+	for {
+		out, err := o.ListAccountsForParent(&input)
+		if err != nil {
+			return err
+		}
+		if !fn(out, out.NextToken == nil) || out.NextToken == nil {
+			return nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// ListAccounts lists every account of the organization.
+func (o *Organizations) ListAccounts(in *organizations.ListAccountsInput) (*organizations.ListAccountsOutput, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var ids []string
+	for id := range o.accounts {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return o.order[ids[i]] < o.order[ids[j]] })
+	start, end, next := o.page(len(ids), in.NextToken)
+	out := &organizations.ListAccountsOutput{NextToken: next}
+	for _, id := range ids[start:end] {
+		out.Accounts = append(out.Accounts, o.accounts[id])
+	}
+	return out, nil
+}
+
+// ListAccountsPages calls fn for every page of ListAccounts.
+func (o *Organizations) ListAccountsPages(in *organizations.ListAccountsInput, fn func(*organizations.ListAccountsOutput, bool) bool) error {
+	input := *in
+	for {
+		out, err := o.ListAccounts(&input)
+		if err != nil {
+			return err
+		}
+		if !fn(out, out.NextToken == nil) || out.NextToken == nil {
+			return nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// CreateOrganizationalUnit creates an OU under an existing parent.
+func (o *Organizations) CreateOrganizationalUnit(in *organizations.CreateOrganizationalUnitInput) (*organizations.CreateOrganizationalUnitOutput, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	ou, err := o.createOU(aws.StringValue(in.ParentId), aws.StringValue(in.Name))
+	if err != nil {
+		return nil, err
+	}
+	return &organizations.CreateOrganizationalUnitOutput{OrganizationalUnit: ou}, nil
+}
+
+// CreateAccount starts an account creation request. The account appears in the root once
+// DescribeCreateAccountStatus has reported IN_PROGRESS CreateAccountPolls times.
+func (o *Organizations) CreateAccount(in *organizations.CreateAccountInput) (*organizations.CreateAccountOutput, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, a := range o.accounts {
+		if *a.Email == aws.StringValue(in.Email) {
+			return nil, awserr.New(organizations.ErrCodeDuplicateAccountException, "an account with email "+*a.Email+" already exists", nil)
+		}
+	}
+	id := o.id("car-")
+	status := &organizations.CreateAccountStatus{
+		Id:          aws.String(id),
+		AccountName: in.AccountName,
+		State:       aws.String(organizations.CreateAccountStateInProgress),
+	}
+	o.requests[id] = &createRequest{
+		name:   aws.StringValue(in.AccountName),
+		email:  aws.StringValue(in.Email),
+		polls:  o.CreateAccountPolls,
+		status: status,
+	}
+	out := *status
+	return &organizations.CreateAccountOutput{CreateAccountStatus: &out}, nil
+}
+
+// DescribeCreateAccountStatus reports the progress of an account creation request.
+func (o *Organizations) DescribeCreateAccountStatus(in *organizations.DescribeCreateAccountStatusInput) (*organizations.DescribeCreateAccountStatusOutput, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.DescribeCreateAccountStatusFailures > 0 {
+		o.DescribeCreateAccountStatusFailures--
+		return nil, awserr.New(organizations.ErrCodeTooManyRequestsException, "rate exceeded", nil)
+	}
+	req, ok := o.requests[aws.StringValue(in.CreateAccountRequestId)]
+	if !ok {
+		return nil, awserr.New(organizations.ErrCodeCreateAccountStatusNotFoundException, "create account request not found", nil)
+	}
+	if *req.status.State == organizations.CreateAccountStateInProgress {
+		if req.polls > 0 {
+			req.polls--
+		} else if o.CreateAccountFailure != "" {
+			req.status.State = aws.String(organizations.CreateAccountStateFailed)
+			req.status.FailureReason = aws.String(o.CreateAccountFailure)
+		} else {
+			acc := o.createAccount(*o.root.Id, req.name, req.email)
+			req.status.State = aws.String(organizations.CreateAccountStateSucceeded)
+			req.status.AccountId = acc.Id
+		}
+	}
+	out := *req.status
+	return &organizations.DescribeCreateAccountStatusOutput{CreateAccountStatus: &out}, nil
+}
+
+// MoveAccount moves an account between parents.
+func (o *Organizations) MoveAccount(in *organizations.MoveAccountInput) (*organizations.MoveAccountOutput, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.MoveAccountFailures > 0 {
+		o.MoveAccountFailures--
+		return nil, awserr.New(organizations.ErrCodeConcurrentModificationException, "the organization is being modified", nil)
+	}
+	id := aws.StringValue(in.AccountId)
+	if _, ok := o.accounts[id]; !ok {
+		return nil, awserr.New(organizations.ErrCodeAccountNotFoundException, "account "+id+" not found", nil)
+	}
+	if o.parents[id] != aws.StringValue(in.SourceParentId) {
+		return nil, awserr.New(organizations.ErrCodeSourceParentNotFoundException, "account "+id+" is not in "+aws.StringValue(in.SourceParentId), nil)
+	}
+	if !o.parentExists(aws.StringValue(in.DestinationParentId)) {
+		return nil, awserr.New(organizations.ErrCodeDestinationParentNotFoundException, "destination parent not found", nil)
+	}
+	if aws.StringValue(in.DestinationParentId) == aws.StringValue(in.SourceParentId) {
+		return nil, awserr.New(organizations.ErrCodeDuplicateAccountException, "account "+id+" is already in "+aws.StringValue(in.SourceParentId), nil)
+	}
+	o.parents[id] = *in.DestinationParentId
+	return &organizations.MoveAccountOutput{}, nil
+}
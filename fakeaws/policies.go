@@ -0,0 +1,224 @@
+package fakeaws
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"sort"
+)
+
+// fullAWSAccessID is the ID of the AWS managed FullAWSAccess policy.
+const fullAWSAccessID = "p-FullAWSAccess"
+
+type policy struct {
+	summary *organizations.PolicySummary
+	content string
+	targets map[string]bool
+}
+
+// PolicyContent returns the content of the policy with a name and whether it exists.
+func (o *Organizations) PolicyContent(name string) (string, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if p := o.policyNamed(name); p != nil {
+		return p.content, true
+	}
+	return "", false
+}
+
+// PolicyTargets returns the sorted IDs of the targets of the policy with a name.
+func (o *Organizations) PolicyTargets(name string) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p := o.policyNamed(name)
+	if p == nil {
+		return nil
+	}
+	var ids []string
+	for id := range p.targets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (o *Organizations) policyNamed(name string) *policy {
+	for _, p := range o.policies {
+		if *p.summary.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (o *Organizations) policy(id *string) (*policy, error) {
+	p, ok := o.policies[aws.StringValue(id)]
+	if !ok {
+		return nil, awserr.New(organizations.ErrCodePolicyNotFoundException, "policy "+aws.StringValue(id)+" not found", nil)
+	}
+	return p, nil
+}
+
+// ListPolicies lists the service control policies. The filter is not checked.
+func (o *Organizations) ListPolicies(in *organizations.ListPoliciesInput) (*organizations.ListPoliciesOutput, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var ids []string
+	for id := range o.policies {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	start, end, next := o.page(len(ids), in.NextToken)
+	out := &organizations.ListPoliciesOutput{NextToken: next}
+	for _, id := range ids[start:end] {
+		summary := *o.policies[id].summary
+		out.Policies = append(out.Policies, &summary)
+	}
+	return out, nil
+}
+
+// ListPoliciesPages calls fn for every page of ListPolicies.
+func (o *Organizations) ListPoliciesPages(in *organizations.ListPoliciesInput, fn func(*organizations.ListPoliciesOutput, bool) bool) error {
+	input := *in
+	for {
+		out, err := o.ListPolicies(&input)
+		if err != nil {
+			return err
+		}
+		if !fn(out, out.NextToken == nil) || out.NextToken == nil {
+			return nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// DescribePolicy returns a policy with its content.
+func (o *Organizations) DescribePolicy(in *organizations.DescribePolicyInput) (*organizations.DescribePolicyOutput, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.policy(in.PolicyId)
+	if err != nil {
+		return nil, err
+	}
+	summary := *p.summary
+	return &organizations.DescribePolicyOutput{Policy: &organizations.Policy{PolicySummary: &summary, Content: aws.String(p.content)}}, nil
+}
+
+// CreatePolicy creates a policy, policy names are unique.
+func (o *Organizations) CreatePolicy(in *organizations.CreatePolicyInput) (*organizations.CreatePolicyOutput, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.policyNamed(aws.StringValue(in.Name)) != nil {
+		return nil, awserr.New(organizations.ErrCodeDuplicatePolicyException, "policy "+aws.StringValue(in.Name)+" already exists", nil)
+	}
+	id := o.id("p-")
+	p := &policy{
+		summary: &organizations.PolicySummary{
+			Id:          aws.String(id),
+			Name:        in.Name,
+			Description: in.Description,
+			Type:        in.Type,
+			AwsManaged:  aws.Bool(false),
+		},
+		content: aws.StringValue(in.Content),
+		targets: make(map[string]bool),
+	}
+	o.policies[id] = p
+	summary := *p.summary
+	return &organizations.CreatePolicyOutput{Policy: &organizations.Policy{PolicySummary: &summary, Content: in.Content}}, nil
+}
+
+// UpdatePolicy replaces the content of a policy.
+func (o *Organizations) UpdatePolicy(in *organizations.UpdatePolicyInput) (*organizations.UpdatePolicyOutput, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.policy(in.PolicyId)
+	if err != nil {
+		return nil, err
+	}
+	if in.Content != nil {
+		p.content = *in.Content
+	}
+	summary := *p.summary
+	return &organizations.UpdatePolicyOutput{Policy: &organizations.Policy{PolicySummary: &summary, Content: aws.String(p.content)}}, nil
+}
+
+// ListTargetsForPolicy lists the roots, OUs and accounts a policy is attached to.
+func (o *Organizations) ListTargetsForPolicy(in *organizations.ListTargetsForPolicyInput) (*organizations.ListTargetsForPolicyOutput, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.policy(in.PolicyId)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for id := range p.targets {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	start, end, next := o.page(len(ids), in.NextToken)
+	out := &organizations.ListTargetsForPolicyOutput{NextToken: next}
+	for _, id := range ids[start:end] {
+		target := &organizations.PolicyTargetSummary{TargetId: aws.String(id)}
+		switch {
+		case id == *o.root.Id:
+			target.Name, target.Type = o.root.Name, aws.String(organizations.TargetTypeRoot)
+		case o.isOU(id):
+			target.Name, target.Type = o.ous[id].Name, aws.String(organizations.TargetTypeOrganizationalUnit)
+		default:
+			target.Name, target.Type = o.accounts[id].Name, aws.String(organizations.TargetTypeAccount)
+		}
+		out.Targets = append(out.Targets, target)
+	}
+	return out, nil
+}
+
+// ListTargetsForPolicyPages calls fn for every page of ListTargetsForPolicy.
+func (o *Organizations) ListTargetsForPolicyPages(in *organizations.ListTargetsForPolicyInput, fn func(*organizations.ListTargetsForPolicyOutput, bool) bool) error {
+	input := *in
+	for {
+		out, err := o.ListTargetsForPolicy(&input)
+		if err != nil {
+			return err
+		}
+		if !fn(out, out.NextToken == nil) || out.NextToken == nil {
+			return nil
+		}
+		input.NextToken = out.NextToken
+	}
+}
+
+// AttachPolicy attaches a policy to the root, an OU or an account.
+func (o *Organizations) AttachPolicy(in *organizations.AttachPolicyInput) (*organizations.AttachPolicyOutput, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.policy(in.PolicyId)
+	if err != nil {
+		return nil, err
+	}
+	target := aws.StringValue(in.TargetId)
+	if !o.parentExists(target) && !o.isAccount(target) {
+		return nil, awserr.New(organizations.ErrCodeTargetNotFoundException, "target "+target+" not found", nil)
+	}
+	if p.targets[target] {
+		return nil, awserr.New(organizations.ErrCodeDuplicatePolicyAttachmentException, "policy is already attached to "+target, nil)
+	}
+	p.targets[target] = true
+	return &organizations.AttachPolicyOutput{}, nil
+}
+
+// DetachPolicy detaches a policy from a target it is attached to.
+func (o *Organizations) DetachPolicy(in *organizations.DetachPolicyInput) (*organizations.DetachPolicyOutput, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	p, err := o.policy(in.PolicyId)
+	if err != nil {
+		return nil, err
+	}
+	target := aws.StringValue(in.TargetId)
+	if !p.targets[target] {
+		return nil, awserr.New(organizations.ErrCodePolicyNotAttachedException, "policy is not attached to "+target, nil)
+	}
+	delete(p.targets, target)
+	return &organizations.DetachPolicyOutput{}, nil
+}
@@ -0,0 +1,113 @@
+package fakeaws
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"io/ioutil"
+	"sync"
+)
+
+// S3 is an in-memory S3 backend keeping objects and bucket policies.
+// Calls that are not implemented panic through the embedded nil interface.
+type S3 struct {
+	s3iface.S3API
+
+	mu            sync.Mutex
+	objects       map[string][]byte
+	policies      map[string]string
+	uploads       int
+	policyUpdates int
+}
+
+// NewS3 returns an empty backend. Every bucket exists.
+func NewS3() *S3 {
+	return &S3{objects: make(map[string][]byte), policies: make(map[string]string)}
+}
+
+// Object returns the content of an object and whether it exists.
+func (c *S3) Object(bucket, key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.objects[bucket+"/"+key]
+	return b, ok
+}
+
+// Policy returns the policy of a bucket, empty when it has none.
+func (c *S3) Policy(bucket string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.policies[bucket]
+}
+
+// Uploads returns the number of PutObject calls.
+func (c *S3) Uploads() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.uploads
+}
+
+// HeadObject fails with NotFound when the object does not exist.
+func (c *S3) HeadObject(in *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)]
+	if !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(b)))}, nil
+}
+
+// PutObject stores an object.
+func (c *S3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	body, err := ioutil.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)] = body
+	c.uploads++
+	return &s3.PutObjectOutput{}, nil
+}
+
+// GetBucketPolicy fails with NoSuchBucketPolicy when the bucket has no policy.
+func (c *S3) GetBucketPolicy(in *s3.GetBucketPolicyInput) (*s3.GetBucketPolicyOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	policy, ok := c.policies[aws.StringValue(in.Bucket)]
+	if !ok {
+		return nil, awserr.New("NoSuchBucketPolicy", "The bucket policy does not exist", nil)
+	}
+	return &s3.GetBucketPolicyOutput{Policy: aws.String(policy)}, nil
+}
+
+// PutBucketPolicy replaces the policy of a bucket.
+func (c *S3) PutBucketPolicy(in *s3.PutBucketPolicyInput) (*s3.PutBucketPolicyOutput, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.policies[aws.StringValue(in.Bucket)] = aws.StringValue(in.Policy)
+	c.policyUpdates++
+	return &s3.PutBucketPolicyOutput{}, nil
+}
+
+// PolicyUpdates returns the number of PutBucketPolicy calls.
+func (c *S3) PolicyUpdates() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.policyUpdates
+}
+
+// GetObjectRequest returns a request of a real client with static credentials, so that it can
+// be presigned without calling AWS.
+func (c *S3) GetObjectRequest(in *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("AKIAFAKE", "fake", ""),
+	}))
+	return s3.New(sess).GetObjectRequest(in)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/service/organizations"
+	cli "github.com/urfave/cli/v2"
+	"log"
+	"os"
+)
+
+func accountMatches(e Account, la *organizations.Account) bool {
+	if e.ID != "" {
+		return e.ID == *la.Id
+	}
+	return e.Alias == *la.Name
+}
+
+func ouMatches(e OrganizationalUnit, id, name string) bool {
+	if e.ID != "" {
+		return e.ID == id
+	}
+	return e.Name == name
+}
+
+// importMerge carries the state of merging the live organization into an existing organization.yaml.
+type importMerge struct {
+	// existing maps a live account ID to its entry in the existing document.
+	existing map[string]*Account
+	matched  map[*Account]bool
+}
+
+// account converts a live account to its organization.yaml entry, keeping the hand-set
+// fields (like template) of the existing entry and refreshing the rest from AWS.
+func (m *importMerge) account(la *organizations.Account) Account {
+	var acc Account
+	if e, ok := m.existing[*la.Id]; ok {
+		acc = *e
+	}
+	acc.ID = *la.Id
+	acc.Alias = *la.Name
+	acc.Email = *la.Email
+	return acc
+}
+
+func (m *importMerge) accounts(live []*organizations.Account, existing []Account) []Account {
+	var out []Account
+	for _, la := range live {
+		out = append(out, m.account(la))
+	}
+	for i := range existing {
+		if !m.matched[&existing[i]] {
+			out = append(out, existing[i])
+		}
+	}
+	return out
+}
+
+// ous merges the live OUs of one level of the tree with the existing OUs of the same level.
+func (m *importMerge) ous(live []*liveOU, existing []OrganizationalUnit) []OrganizationalUnit {
+	var out []OrganizationalUnit
+	used := make(map[int]bool)
+	for _, lou := range live {
+		var ou OrganizationalUnit
+		var prev OrganizationalUnit
+		for i, e := range existing {
+			if !used[i] && ouMatches(e, lou.ID, lou.Name) {
+				used[i] = true
+				prev, ou = e, e
+				break
+			}
+		}
+		ou.ID = lou.ID
+		ou.Name = lou.Name
+		ou.Accounts = m.accounts(lou.Accounts, prev.Accounts)
+		ou.OrganizationalUnits = m.ous(lou.OUs, prev.OrganizationalUnits)
+		out = append(out, ou)
+	}
+	for i, e := range existing {
+		if !used[i] {
+			e.Accounts = m.accounts(nil, e.Accounts)
+			e.OrganizationalUnits = m.ous(nil, e.OrganizationalUnits)
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// importOrganization builds an organization.yaml document from the live organization,
+// merging it into the existing document. Entries only present in the existing document are kept.
+func importOrganization(live *liveOrganization, existing Organization) Organization {
+	m := &importMerge{existing: make(map[string]*Account), matched: make(map[*Account]bool)}
+
+	var pool []*Account
+	for i := range existing.Accounts {
+		pool = append(pool, &existing.Accounts[i])
+	}
+	walkOrganizationalUnits(existing.OrganizationalUnits, "", func(path string, ou *OrganizationalUnit) {
+		for i := range ou.Accounts {
+			pool = append(pool, &ou.Accounts[i])
+		}
+	})
+	var walk func(u *liveOU)
+	walk = func(u *liveOU) {
+		for _, la := range u.Accounts {
+			for _, e := range pool {
+				if !m.matched[e] && accountMatches(*e, la) {
+					m.matched[e] = true
+					m.existing[*la.Id] = e
+					break
+				}
+			}
+		}
+		for _, c := range u.OUs {
+			walk(c)
+		}
+	}
+	walk(live.Root)
+
+	return Organization{
+		Parameters:          existing.Parameters,
+		SCPs:                existing.SCPs,
+		Accounts:            m.accounts(live.Root.Accounts, existing.Accounts),
+		OrganizationalUnits: m.ous(live.Root.OUs, existing.OrganizationalUnits),
+	}
+}
+
+// Import writes organization.yaml from the live organization.
+func Import(ctx *cli.Context) error {
+	var existing Organization
+	if _, err := os.Stat("organization.yaml"); err == nil && !ctx.Bool("replace") {
+		existing = readOrgYaml()
+	}
+	orgC := makeOrgClient(profile, orgRole)
+	live, err := loadLiveOrganization(orgC)
+	if err != nil {
+		return err
+	}
+	org := importOrganization(live, existing)
+	writeOrgYaml(org)
+	log.Println("INFO: organization.yaml is updated from the live organization")
+	return nil
+}
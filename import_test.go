@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestImportOrganization(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	fake.org.PageSize = 1
+	master := fake.org.AddAccount(fake.org.RootID(), "master", "master@example.com")
+	workloads := fake.org.AddOU(fake.org.RootID(), "Workloads")
+	prod := fake.org.AddOU(workloads, "Prod")
+	data := fake.org.AddAccount(prod, "data", "data@example.com")
+	fake.org.AddAccount(prod, "analytics", "analytics@example.com")
+
+	existing := Organization{Parameters: map[string]string{"Environment": "shared"}, SCPs: []string{"deny-leave"}, OrganizationalUnits: []OrganizationalUnit{
+		{Name: "Workloads", Parameters: map[string]string{"Environment": "workloads"}, SCPs: []string{"region-lock"}, Accounts: []Account{
+			// Moved to Workloads/Prod in the console, keeps its template.
+			{ID: data, Alias: "data", Email: "old@example.com", TemplateFile: "policies/Data-Policies", Parameters: map[string]string{"Environment": "data"}},
+			// Not created yet.
+			{Alias: "pending", Email: "pending@example.com"},
+		}},
+		{Name: "Sandbox"},
+	}}
+	live, err := loadLiveOrganization(fake.org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	org := importOrganization(live, existing)
+
+	if org.Parameters["Environment"] != "shared" {
+		t.Errorf("organization parameters = %v", org.Parameters)
+	}
+	if len(org.SCPs) != 1 || org.SCPs[0] != "deny-leave" {
+		t.Errorf("organization scps = %v", org.SCPs)
+	}
+	if len(org.Accounts) != 1 || org.Accounts[0].ID != master {
+		t.Errorf("root accounts = %+v", org.Accounts)
+	}
+	if got := organizationalUnitPaths(org.OrganizationalUnits); len(got) != 3 || got[0] != "Workloads" || got[1] != "Workloads/Prod" || got[2] != "Sandbox" {
+		t.Errorf("paths = %v", got)
+	}
+	w := findOrganizationalUnit(org.OrganizationalUnits, "Workloads")
+	if w.ID != workloads || w.Parameters["Environment"] != "workloads" || len(w.SCPs) != 1 || len(w.Accounts) != 1 || w.Accounts[0].Alias != "pending" {
+		t.Errorf("Workloads = %+v", w)
+	}
+	p := findOrganizationalUnit(org.OrganizationalUnits, "Workloads/Prod")
+	if p.ID != prod || len(p.Accounts) != 2 {
+		t.Fatalf("Workloads/Prod = %+v", p)
+	}
+	if a := p.Accounts[0]; a.ID != data || a.Email != "data@example.com" || a.TemplateFile != "policies/Data-Policies" || a.Parameters["Environment"] != "data" {
+		t.Errorf("merged account = %+v", a)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+const journalFile = "creation-journal.yaml"
+
+// Steps of an account creation, in the order they complete.
+const (
+	stepRequested       = "requested"
+	stepSucceeded       = "succeeded"
+	stepMoved           = "moved"
+	stepTemplated       = "templated" // only in older journals, templates are no longer copied per account
+	stepYamlWritten     = "yaml-written"
+	stepPoliciesApplied = "policies-applied"
+)
+
+// journalEntry records the last completed step of an account creation so it can be resumed.
+type journalEntry struct {
+	RequestID string    `yaml:"request_id"`
+	Alias     string    `yaml:"alias"`
+	Email     string    `yaml:"email"`
+	OU        string    `yaml:"ou,omitempty"`
+	AccountID string    `yaml:"account_id,omitempty"`
+	Step      string    `yaml:"step"`
+	UpdatedAt time.Time `yaml:"updated_at"`
+}
+
+func readJournal() []journalEntry {
+	var entries []journalEntry
+	content, err := ioutil.ReadFile(journalFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Fatalf("ERROR: failed to read the creation journal: %v", err)
+	}
+	err = yaml.Unmarshal(content, &entries)
+	if err != nil {
+		log.Fatalf("ERROR: failed in unmarshalling the creation journal: %v", err)
+	}
+	return entries
+}
+
+// recordJournal adds the entry to the journal, replacing the entry of the same request.
+func recordJournal(entry journalEntry) {
+	entry.UpdatedAt = time.Now().UTC()
+	entries := readJournal()
+	recorded := false
+	for i, e := range entries {
+		if e.RequestID == entry.RequestID {
+			entries[i] = entry
+			recorded = true
+		}
+	}
+	if !recorded {
+		entries = append(entries, entry)
+	}
+	content, err := yaml.Marshal(entries)
+	if err != nil {
+		log.Fatalf("ERROR: Failed to marshal the creation journal: %v", err)
+	}
+	err = ioutil.WriteFile(journalFile, content, 0644)
+	if err != nil {
+		log.Fatalf("ERROR: Failed to update the creation journal: %v", err)
+	}
+}
+
+// Resume continues every unfinished account creation of the journal.
+func Resume(cfg Config) error {
+	orgC := makeOrgClient(profile, orgRole)
+	var failed error
+	pending := 0
+	for _, entry := range readJournal() {
+		if entry.Step == stepPoliciesApplied {
+			continue
+		}
+		pending++
+		log.Printf("INFO: Resuming creation of account %s after step %s", entry.Alias, entry.Step)
+		if err := continueAccountCreation(cfg, orgC, entry); err != nil {
+			log.Printf("ERROR: Failed to resume creation of account %s: %v", entry.Alias, err)
+			failed = err
+		}
+	}
+	if pending == 0 {
+		log.Println("INFO: No unfinished account creation in the journal")
+	}
+	return failed
+}
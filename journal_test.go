@@ -0,0 +1,79 @@
+package main
+
+import (
+	cfm "github.com/aws/aws-sdk-go/service/cloudformation"
+	"strings"
+	"testing"
+)
+
+func TestResume(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	prod := fake.org.AddOU(fake.org.RootID(), "Prod")
+	writeOrgYaml(Organization{Accounts: []Account{iam}, OrganizationalUnits: []OrganizationalUnit{{ID: prod, Name: "Prod"}}})
+	// Still in progress after the 15 polls of CreateAccount.
+	fake.org.CreateAccountPolls = 20
+
+	err := CreateAccount(testConfig, Account{Alias: "data", Email: "data@example.com", root: "Prod"})
+	if err == nil || !strings.Contains(err.Error(), "took too long") {
+		t.Fatalf("err = %v", err)
+	}
+	entries := readJournal()
+	if len(entries) != 1 || entries[0].Step != stepRequested || entries[0].RequestID == "" {
+		t.Fatalf("journal = %+v", entries)
+	}
+
+	if err := Resume(testConfig); err != nil {
+		t.Fatal(err)
+	}
+	entries = readJournal()
+	if len(entries) != 1 || entries[0].Step != stepPoliciesApplied || entries[0].AccountID == "" {
+		t.Fatalf("journal = %+v", entries)
+	}
+	if fake.org.ParentOf(entries[0].AccountID) != prod {
+		t.Errorf("account was not moved to Prod")
+	}
+	if ou := findOrganizationalUnit(readOrgYaml().OrganizationalUnits, "Prod"); len(ou.Accounts) != 1 || ou.Accounts[0].ID != entries[0].AccountID {
+		t.Errorf("organization.yaml Prod = %+v", ou)
+	}
+	if s := fake.account(entries[0].AccountID).Stack("Data-Policies"); s == nil || s.Status != cfm.StackStatusCreateComplete {
+		t.Errorf("policy stack = %+v", s)
+	}
+
+	// Finished creations are not resumed again.
+	if err := Resume(testConfig); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeKeepsOrgYamlEntry(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	prod := fake.org.AddOU(fake.org.RootID(), "Prod")
+	writeOrgYaml(Organization{Accounts: []Account{iam}, OrganizationalUnits: []OrganizationalUnit{{ID: prod, Name: "Prod"}}})
+	fake.org.MoveAccountFailures = moveAccountAttempts + 1
+
+	err := CreateAccount(testConfig, Account{Alias: "data", Email: "data@example.com", root: "Prod"})
+	if err == nil || !strings.Contains(err.Error(), accountStatePendingMove) {
+		t.Fatalf("err = %v", err)
+	}
+	// The entry is completed by hand while the account waits for its move.
+	org := readOrgYaml()
+	a := &findOrganizationalUnit(org.OrganizationalUnits, "Prod").Accounts[0]
+	a.Parameters = map[string]string{"Owner": "data-team"}
+	a.SCPs = []string{"region-lock"}
+	a.Tags = map[string]string{"team": "data"}
+	writeOrgYaml(org)
+
+	if err := Resume(testConfig); err != nil {
+		t.Fatal(err)
+	}
+	ou := findOrganizationalUnit(readOrgYaml().OrganizationalUnits, "Prod")
+	if len(ou.Accounts) != 1 {
+		t.Fatalf("organization.yaml Prod = %+v", ou)
+	}
+	got := ou.Accounts[0]
+	if got.State != "" || got.ID == "" || got.Parameters["Owner"] != "data-team" || len(got.SCPs) != 1 || got.Tags["team"] != "data" {
+		t.Errorf("account after resume = %+v", got)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+)
+
+// liveOU is a snapshot of an organizational unit (or the root) as it exists in AWS.
+type liveOU struct {
+	ID       string
+	Name     string
+	ParentID string
+	OUs      []*liveOU
+	Accounts []*organizations.Account
+}
+
+// liveOrganization is a snapshot of the whole organization tree starting at the root.
+type liveOrganization struct {
+	Root *liveOU
+}
+
+// loadLiveOrganization walks the organization from its root and returns the OUs and accounts found.
+func loadLiveOrganization(orgC organizationsiface.OrganizationsAPI) (*liveOrganization, error) {
+	Lro, err := orgC.ListRoots(&organizations.ListRootsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Failed to list roots in organization: %v", err)
+	}
+	if len(Lro.Roots) == 0 {
+		return nil, fmt.Errorf("ERROR: No root found in the organization")
+	}
+	root := &liveOU{ID: *Lro.Roots[0].Id, Name: *Lro.Roots[0].Name}
+	if err := loadLiveOU(orgC, root); err != nil {
+		return nil, err
+	}
+	return &liveOrganization{Root: root}, nil
+}
+
+func loadLiveOU(orgC organizationsiface.OrganizationsAPI, parent *liveOU) error {
+	err := orgC.ListAccountsForParentPages(&organizations.ListAccountsForParentInput{
+		ParentId: aws.String(parent.ID),
+	}, func(page *organizations.ListAccountsForParentOutput, lastPage bool) bool {
+		parent.Accounts = append(parent.Accounts, page.Accounts...)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("ERROR: Failed to list accounts under %s: %v", parent.Name, err)
+	}
+	var children []*liveOU
+	err = orgC.ListOrganizationalUnitsForParentPages(&organizations.ListOrganizationalUnitsForParentInput{
+		ParentId: aws.String(parent.ID),
+	}, func(page *organizations.ListOrganizationalUnitsForParentOutput, lastPage bool) bool {
+		for _, u := range page.OrganizationalUnits {
+			children = append(children, &liveOU{ID: *u.Id, Name: *u.Name, ParentID: parent.ID})
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("ERROR: Failed to list organizational units under %s: %v", parent.Name, err)
+	}
+	for _, child := range children {
+		if err := loadLiveOU(orgC, child); err != nil {
+			return err
+		}
+	}
+	parent.OUs = children
+	return nil
+}
+
+// walkLive calls fn for u and every OU below it, parents before children, together with
+// the slash-separated path of the OU from the root. The root itself has the empty path.
+func walkLive(u *liveOU, path string, fn func(path string, u *liveOU)) {
+	fn(path, u)
+	for _, c := range u.OUs {
+		childPath := c.Name
+		if path != "" {
+			childPath = path + "/" + c.Name
+		}
+		walkLive(c, childPath, fn)
+	}
+}
+
+// paths indexes every OU of the tree by its path from the root.
+func (o *liveOrganization) paths() map[string]*liveOU {
+	paths := make(map[string]*liveOU)
+	walkLive(o.Root, "", func(path string, u *liveOU) {
+		paths[path] = u
+	})
+	return paths
+}
+
+// child returns the direct child OU with the given name, or nil.
+func (u *liveOU) child(name string) *liveOU {
+	for _, c := range u.OUs {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// findAccount searches the whole tree for an account by ID, falling back to its name,
+// and returns the account together with the ID of its parent.
+func (o *liveOrganization) findAccount(id, name string) (*organizations.Account, string) {
+	var byName *organizations.Account
+	var byNameParent string
+	var found *organizations.Account
+	var foundParent string
+	var walk func(u *liveOU)
+	walk = func(u *liveOU) {
+		for _, a := range u.Accounts {
+			if id != "" && *a.Id == id {
+				found, foundParent = a, u.ID
+				return
+			}
+			if byName == nil && name != "" && *a.Name == name {
+				byName, byNameParent = a, u.ID
+			}
+		}
+		for _, c := range u.OUs {
+			if found != nil {
+				return
+			}
+			walk(c)
+		}
+	}
+	walk(o.Root)
+	if found != nil {
+		return found, foundParent
+	}
+	return byName, byNameParent
+}
@@ -6,14 +6,18 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	cfm "github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
 	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	cli "github.com/urfave/cli/v2"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"log"
 	"os"
 	"reflect"
+	"strings"
 )
 
 const (
@@ -22,23 +26,43 @@ const (
 	iamUserBillingAccess     = "ALLOW"
 	orgFeatureSet            = "ALL"
 	defaultRegion            = "us-west-2"
+
+	// accountStatePendingMove marks an account that was created but could not be moved to its OU yet.
+	accountStatePendingMove = "pending_move"
+
+	// roleIdentityHub is the account holding the IAM users and groups of the organization.
+	roleIdentityHub = "identity-hub"
+	roleProduction  = "production"
 )
 
+// roleParameters maps an account role to the stack parameter receiving the ID of the account with that role.
+var roleParameters = map[string]string{
+	roleIdentityHub: "IamAccountID",
+	roleProduction:  "ProdccountID",
+}
+
 var (
 	orgRole, profile string
 )
 
 // Organization ...
 type Organization struct {
+	Parameters          map[string]string    `yaml:"parameters,omitempty"`
+	SCPs                []string             `yaml:"scps,omitempty"`
+	Accounts            []Account            `yaml:"accounts,omitempty"`
 	OrganizationalUnits []OrganizationalUnit `yaml:"organizationalunits"`
 }
 
 // OrganizationalUnit ...
 type OrganizationalUnit struct {
-	ID       string    `yaml:"id"`
-	Name     string    `yaml:"name"`
-	parent   string    `yaml:"parent"`
-	Accounts []Account `yaml:"accounts"`
+	ID                  string `yaml:"id"`
+	Name                string `yaml:"name"`
+	parent              string
+	Accounts            []Account            `yaml:"accounts"`
+	OrganizationalUnits []OrganizationalUnit `yaml:"organizationalunits,omitempty"`
+	Parameters          map[string]string    `yaml:"parameters,omitempty"`
+	Regions             []string             `yaml:"regions,omitempty"`
+	SCPs                []string             `yaml:"scps,omitempty"`
 }
 
 // Account ...
@@ -47,7 +71,44 @@ type Account struct {
 	Alias        string `yaml:"alias"`
 	Email        string `yaml:"email"`
 	root         string
-	TemplateFile string `yaml:"template"`
+	TemplateFile string            `yaml:"template,omitempty"`
+	State        string            `yaml:"state,omitempty"`
+	Role         string            `yaml:"role,omitempty"`
+	Parameters   map[string]string `yaml:"parameters,omitempty"`
+	Regions      []string          `yaml:"regions,omitempty"`
+	Tags         map[string]string `yaml:"tags,omitempty"`
+	SCPs         []string          `yaml:"scps,omitempty"`
+}
+
+// allAccounts returns the accounts directly under the root followed by the accounts of every OU in the tree.
+func (org Organization) allAccounts() []Account {
+	accounts := append([]Account{}, org.Accounts...)
+	walkOrganizationalUnits(org.OrganizationalUnits, "", func(path string, ou *OrganizationalUnit) {
+		accounts = append(accounts, ou.Accounts...)
+	})
+	return accounts
+}
+
+// roleAccounts returns the accounts declaring a role, by role. Every role may be declared by
+// one account at most and exactly one account must be the identity hub.
+func (org Organization) roleAccounts() (map[string]Account, error) {
+	roles := make(map[string]Account)
+	for _, a := range org.allAccounts() {
+		if a.Role == "" {
+			continue
+		}
+		if _, ok := roleParameters[a.Role]; !ok {
+			return nil, fmt.Errorf("ERROR: Account %s has the unknown role %s", a.Alias, a.Role)
+		}
+		if prev, ok := roles[a.Role]; ok {
+			return nil, fmt.Errorf("ERROR: Accounts %s and %s both have the role %s", prev.Alias, a.Alias, a.Role)
+		}
+		roles[a.Role] = a
+	}
+	if _, ok := roles[roleIdentityHub]; !ok {
+		return nil, fmt.Errorf("ERROR: No account has the role %s in organization.yaml", roleIdentityHub)
+	}
+	return roles, nil
 }
 
 func readOrgYaml() Organization {
@@ -67,16 +128,36 @@ func updateOrgYaml(input interface{}) {
 	org := readOrgYaml()
 	if reflect.TypeOf(input).Name() == "OrganizationalUnit" {
 		ou := input.(OrganizationalUnit)
-		org.OrganizationalUnits = append(org.OrganizationalUnits, ou)
+		if ou.parent == "" {
+			org.OrganizationalUnits = append(org.OrganizationalUnits, ou)
+		} else {
+			// A parent missing from organization.yaml is added, so the OU keeps its real path.
+			p := ensureOrganizationalUnitPath(&org, ou.parent)
+			p.OrganizationalUnits = append(p.OrganizationalUnits, ou)
+		}
 	} else if reflect.TypeOf(input).Name() == "Account" {
 		acc := input.(Account)
-		for i, u := range org.OrganizationalUnits {
-			if u.Name == acc.root {
-				org.OrganizationalUnits[i].Accounts = append(org.OrganizationalUnits[i].Accounts, acc)
-				break
+		accounts := &org.Accounts
+		if acc.root != "" {
+			// An OU missing from organization.yaml is added, so the account is always recorded.
+			accounts = &ensureOrganizationalUnitPath(&org, acc.root).Accounts
+		}
+		recorded := false
+		for i, a := range *accounts {
+			if a.Alias == acc.Alias {
+				// The entry keeps its hand-set fields, only what the creation learned is updated.
+				(*accounts)[i].ID, (*accounts)[i].Email, (*accounts)[i].State = acc.ID, acc.Email, acc.State
+				recorded = true
 			}
 		}
+		if !recorded {
+			*accounts = append(*accounts, acc)
+		}
 	}
+	writeOrgYaml(org)
+}
+
+func writeOrgYaml(org Organization) {
 	content, err := yaml.Marshal(org)
 	if err != nil {
 		log.Fatalf("ERROR: Failed to marshal the organizational unit data: %v", err)
@@ -97,35 +178,48 @@ func makeAwsSession(profile string) *session.Session {
 	return sess
 }
 
-func getCfmClient(profile, assumeRole string) *cfm.CloudFormation {
+// clientFactory builds the AWS clients used by the commands. Tests replace it with
+// a factory returning the in-memory backends of the fakeaws package.
+type clientFactory interface {
+	CloudFormation(profile, assumeRole, region string) cloudformationiface.CloudFormationAPI
+	S3(profile, assumeRole, region string) s3iface.S3API
+	Organizations(profile, assumeRole string) organizationsiface.OrganizationsAPI
+}
+
+var clients clientFactory = awsClientFactory{}
+
+// awsClientFactory builds SDK clients from the shared config profile, assuming the role when one is given.
+type awsClientFactory struct{}
+
+func (awsClientFactory) CloudFormation(profile, assumeRole, region string) cloudformationiface.CloudFormationAPI {
 	var cfmC *cfm.CloudFormation
 	sess := makeAwsSession(profile)
 	if assumeRole != "" {
 		cfmC = cfm.New(sess, &aws.Config{
 			Credentials: stscreds.NewCredentials(sess, assumeRole),
-			Region:      aws.String(defaultRegion),
+			Region:      aws.String(region),
 		})
 		return cfmC
 	}
-	cfmC = cfm.New(sess, aws.NewConfig().WithRegion(defaultRegion))
+	cfmC = cfm.New(sess, aws.NewConfig().WithRegion(region))
 	return cfmC
 }
 
-func getS3Client(profile, assumeRole string) *s3.S3 {
+func (awsClientFactory) S3(profile, assumeRole, region string) s3iface.S3API {
 	var s3C *s3.S3
 	sess := makeAwsSession(profile)
 	if assumeRole != "" {
 		s3C = s3.New(sess, &aws.Config{
 			Credentials: stscreds.NewCredentials(sess, assumeRole),
-			Region:      aws.String(defaultRegion),
+			Region:      aws.String(region),
 		})
 		return s3C
 	}
-	s3C = s3.New(sess, aws.NewConfig().WithRegion(defaultRegion))
+	s3C = s3.New(sess, aws.NewConfig().WithRegion(region))
 	return s3C
 }
 
-func makeOrgClient(profile, assumeRole string) *organizations.Organizations {
+func (awsClientFactory) Organizations(profile, assumeRole string) organizationsiface.OrganizationsAPI {
 	var orgC *organizations.Organizations
 	sess := makeAwsSession(profile)
 	if assumeRole != "" {
@@ -138,6 +232,18 @@ func makeOrgClient(profile, assumeRole string) *organizations.Organizations {
 	return orgC
 }
 
+func getCfmClient(profile, assumeRole, region string) cloudformationiface.CloudFormationAPI {
+	return clients.CloudFormation(profile, assumeRole, region)
+}
+
+func getS3Client(profile, assumeRole, region string) s3iface.S3API {
+	return clients.S3(profile, assumeRole, region)
+}
+
+func makeOrgClient(profile, assumeRole string) organizationsiface.OrganizationsAPI {
+	return clients.Organizations(profile, assumeRole)
+}
+
 func uniq(input []string) []string {
 	u := make([]string, 0, len(input))
 	m := make(map[string]bool)
@@ -169,6 +275,7 @@ func CreateOrganization(ctx *cli.Context) error {
 }
 
 func main() {
+	var cfg Config
 
 	runCreateOU := func(ctx *cli.Context) error {
 		ouName := ctx.String("name")
@@ -186,33 +293,87 @@ func main() {
 		accountEmail := ctx.String("email")
 		accountUnit := ctx.String("ou")
 		acc := Account{Alias: accountAlias, Email: accountEmail, root: accountUnit}
-		err := CreateAccount(acc)
+		err := CreateAccount(cfg, acc)
 		return err
 	}
 
 	runUpdatePolicy := func(ctx *cli.Context) error {
-		if ctx.IsSet("accounts") {
-			err := UpdatePolicies(ctx.StringSlice("accounts"), ctx.IsSet("updateiam"))
+		params, err := parseParameters(ctx.StringSlice("parameter"))
+		if err != nil {
 			return err
 		}
-		var acc []string
-		org := readOrgYaml()
-		for _, ou := range org.OrganizationalUnits {
-			for _, a := range ou.Accounts {
-				acc = append(acc, a.Alias)
+		opts := policyOptions{
+			UpdateIAM:        ctx.IsSet("updateiam"),
+			Parallelism:      ctx.Int("parallelism"),
+			FailFast:         ctx.Bool("fail-fast"),
+			Parameters:       params,
+			DryRun:           ctx.Bool("dry-run"),
+			Output:           ctx.String("output"),
+			AutoApprove:      ctx.Bool("auto-approve"),
+			Approval:         ctx.String("approval"),
+			AllowReplacement: ctx.Bool("allow-replacement"),
+			WaitTimeout:      ctx.Duration("wait-timeout"),
+		}
+		if ctx.IsSet("accounts") || ctx.IsSet("ou") {
+			acc := ctx.StringSlice("accounts")
+			if ctx.IsSet("ou") {
+				org := readOrgYaml()
+				paths := organizationalUnitPaths(org.OrganizationalUnits)
+				for _, sel := range ctx.StringSlice("ou") {
+					selected, err := resolveOUPath(paths, sel)
+					if err != nil {
+						return fmt.Errorf("ERROR: Failed to select accounts of %s: %v", sel, err)
+					}
+					walkOrganizationalUnits(org.OrganizationalUnits, "", func(path string, ou *OrganizationalUnit) {
+						if path == selected || strings.HasPrefix(path, selected+"/") {
+							for _, a := range ou.Accounts {
+								acc = append(acc, a.Alias)
+							}
+						}
+					})
+				}
 			}
+			err = UpdatePolicies(cfg, uniq(acc), opts)
+			return err
+		}
+		var acc []string
+		for _, a := range readOrgYaml().allAccounts() {
+			acc = append(acc, a.Alias)
 		}
-		err := UpdatePolicies(acc, ctx.IsSet("updateiam"))
+		err = UpdatePolicies(cfg, acc, opts)
 		return err
 	}
 
+	runResume := func(ctx *cli.Context) error {
+		return Resume(cfg)
+	}
+
+	runRepairStack := func(ctx *cli.Context) error {
+		opts := policyOptions{AutoApprove: ctx.Bool("auto-approve"), WaitTimeout: ctx.Duration("wait-timeout")}
+		return RepairStacks(cfg, ctx.StringSlice("accounts"), opts)
+	}
+
+	runValidate := func(ctx *cli.Context) error {
+		params, err := parseParameters(ctx.StringSlice("parameter"))
+		if err != nil {
+			return err
+		}
+		opts := validateOptions{Parameters: params, Remote: ctx.Bool("remote")}
+		return ValidateTemplates(cfg, ctx.StringSlice("accounts"), opts)
+	}
+
 	app := &cli.App{
 		Name:        "organization governor",
 		Version:     version,
 		Description: "A governor to manage organizations in aws",
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.StringFlag{Name: "profile", Aliases: []string{"p"}, Value: "default", Destination: &profile},
 			&cli.StringFlag{Name: "role", Usage: "Role to be assumed to interact with Organizations", Destination: &orgRole},
+		}, configFlags()...),
+		Before: func(ctx *cli.Context) error {
+			var err error
+			cfg, err = loadConfig(ctx)
+			return err
 		},
 		Commands: []*cli.Command{
 			{
@@ -229,7 +390,7 @@ func main() {
 				Description: "Create an organizational unit to segregate accounts based on the requirement",
 				Flags: []cli.Flag{
 					&cli.StringFlag{Name: "name", Usage: "`name` for the organizational unit", Required: true},
-					&cli.StringFlag{Name: "parent", Usage: "`parent` for the organizational unit"},
+					&cli.StringFlag{Name: "parent", Usage: "`parent` for the organizational unit, either a name or a path like Workloads/Prod"},
 				},
 				Action: runCreateOU,
 			},
@@ -241,10 +402,16 @@ func main() {
 				Flags: []cli.Flag{
 					&cli.StringFlag{Name: "name", Usage: "`name` for the organizational unit"},
 					&cli.StringFlag{Name: "email", Usage: "`parent` for the organizational unit", Required: true},
-					&cli.StringFlag{Name: "ou", Usage: "Organizational Unit to move the account"},
+					&cli.StringFlag{Name: "ou", Usage: "Organizational Unit to move the account, either a name or a path like Workloads/Prod/Data"},
 				},
 				Action: runCreateAccount,
 			},
+			{
+				Name:        "resume",
+				Usage:       "use it to finish account creations that were interrupted",
+				Description: "Continue every unfinished account creation of the creation journal from its last completed step",
+				Action:      runResume,
+			},
 			{
 				Name:        "update-policy",
 				Aliases:     []string{"up-pol"},
@@ -252,10 +419,78 @@ func main() {
 				Description: "Update the respective accounts policy",
 				Flags: []cli.Flag{
 					&cli.StringSliceFlag{Name: "accounts", Aliases: []string{"acc"}, Usage: "Pass the accounts for which the policy to be updated"},
+					&cli.StringSliceFlag{Name: "ou", Usage: "Update the policies of every account under the organizational unit `path`"},
 					&cli.BoolFlag{Name: "updateiam", Usage: "Flag to inform whether to update the iam groups or not"},
+					&cli.IntFlag{Name: "parallelism", Value: 4, Usage: "Number of accounts to update at the same time"},
+					&cli.BoolFlag{Name: "fail-fast", Usage: "Skip the remaining accounts once an account fails"},
+					&cli.StringSliceFlag{Name: "parameter", Usage: "Stack parameter as `Key=Value`, overriding organization.yaml. Can be repeated"},
+					&cli.BoolFlag{Name: "dry-run", Usage: "Show the changes of every stack and delete the change sets without executing them"},
+					&cli.StringFlag{Name: "output", Value: outputTable, Usage: "`format` of the dry run changes, table or json"},
+					&cli.BoolFlag{Name: "auto-approve", Usage: "Execute the change sets without asking for an approval, required to delete or replace resources without a terminal"},
+					&cli.StringFlag{Name: "approval", Value: approvalBatch, Usage: "Ask for an approval once for the whole batch or for every account, `batch` or account"},
+					&cli.BoolFlag{Name: "allow-replacement", Usage: "Let the change sets replace or remove IAM roles, policies and groups"},
+					&cli.DurationFlag{Name: "wait-timeout", Value: defaultStackWaitTimeout, Usage: "How long to wait for a stack busy with another operation"},
 				},
 				Action: runUpdatePolicy,
 			},
+			{
+				Name:        "repair-stack",
+				Usage:       "use it to recover policy stacks from failed and rolled back states",
+				Description: "Recover the policy stacks of the accounts from failed and rolled back states. A stack in ROLLBACK_COMPLETE is deleted, the next update-policy creates it again",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{Name: "accounts", Aliases: []string{"acc"}, Usage: "Accounts whose policy stacks are repaired", Required: true},
+					&cli.BoolFlag{Name: "auto-approve", Usage: "Delete unusable stacks without asking for an approval"},
+					&cli.DurationFlag{Name: "wait-timeout", Value: defaultStackWaitTimeout, Usage: "How long to wait for a stack busy with another operation"},
+				},
+				Action: runRepairStack,
+			},
+			{
+				Name:        "validate",
+				Usage:       "use it to check the policy templates before deploying them",
+				Description: "Parse the policy template of every account and check the parameters update-policy passes and the outputs the iam groups are updated from",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{Name: "accounts", Aliases: []string{"acc"}, Usage: "Accounts whose templates are checked, every account when not given"},
+					&cli.StringSliceFlag{Name: "parameter", Usage: "Stack parameter as `Key=Value`, as given to update-policy. Can be repeated"},
+					&cli.BoolFlag{Name: "remote", Usage: "Also check the templates with the CloudFormation ValidateTemplate API"},
+				},
+				Action: runValidate,
+			},
+			{
+				Name:        "plan",
+				Usage:       "Use it to preview the changes needed to match organization.yaml",
+				Description: "Compare organization.yaml with the live organization and print the OUs, accounts and moves to be made",
+				Action:      Plan,
+			},
+			{
+				Name:        "apply",
+				Usage:       "Use it to converge the organization to organization.yaml",
+				Description: "Create the missing OUs and accounts and move accounts so the organization matches organization.yaml",
+				Action:      Apply,
+			},
+			{
+				Name:        "import",
+				Usage:       "Use it to bootstrap organization.yaml from an existing organization",
+				Description: "Write the OUs and accounts of the live organization to organization.yaml, merging into the existing file",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "replace", Usage: "Discard the existing organization.yaml instead of merging into it"},
+				},
+				Action: Import,
+			},
+			{
+				Name:        "drift",
+				Usage:       "Use it to detect differences between organization.yaml and the organization",
+				Description: "Report accounts and OUs that differ between organization.yaml and AWS, exiting with a non-zero code when drift is found",
+				Action:      Drift,
+			},
+			{
+				Name:        "sync-scp",
+				Usage:       "Use it to create, update and attach the service control policies of organization.yaml",
+				Description: "Create and update the SCPs of policies/scp referenced in organization.yaml, attach them to their root, OUs and accounts and detach them where they are no longer listed",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "dry-run", Usage: "Print the SCP changes without making them"},
+				},
+				Action: SyncSCPs,
+			},
 		},
 	}
 
@@ -268,7 +503,5 @@ func main() {
 
 /*
 	Additional Features:
-	1. Add Parameters flag to the update-policy which is tobe used as cloudformation parameters.
-	2. Add support for the initial account setup apart from policies
-	3. Add multilevel organizationunit create and update support
+	1. Add support for the initial account setup apart from policies
 */
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"github.com/annemakhil/org-governor/fakeaws"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testTemplate = `{
+  "AWSTemplateFormatVersion": "2010-09-09",
+  "Parameters": {
+    "IamAccountID": {"Type": "String"},
+    "ProdccountID": {"Type": "String"}
+  },
+  "Resources": {}
+}
+`
+
+// testConfig is the tool configuration used by the tests.
+var testConfig = Config{
+	TemplateBucket:    "templates",
+	Region:            defaultRegion,
+	AccountAccessRole: defaultAccountAccessRole,
+	StackName:         defaultStackName,
+	TemplateSharing:   sharingOrgPolicy,
+	DefaultTemplate:   defaultTemplate,
+}
+
+// fakeClients serves the fakeaws backends. Each assumed role and region gets its own
+// CloudFormation backend, so every account has its own stacks in every region.
+type fakeClients struct {
+	org *fakeaws.Organizations
+	s3  *fakeaws.S3
+
+	mu  sync.Mutex
+	cfm map[string]*fakeaws.CloudFormation
+}
+
+func (f *fakeClients) CloudFormation(profile, assumeRole, region string) cloudformationiface.CloudFormationAPI {
+	return f.stacks(assumeRole, region)
+}
+
+func (f *fakeClients) S3(profile, assumeRole, region string) s3iface.S3API {
+	return f.s3
+}
+
+func (f *fakeClients) Organizations(profile, assumeRole string) organizationsiface.OrganizationsAPI {
+	return f.org
+}
+
+func (f *fakeClients) stacks(assumeRole, region string) *fakeaws.CloudFormation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := assumeRole + " " + region
+	c, ok := f.cfm[key]
+	if !ok {
+		c = fakeaws.NewCloudFormation()
+		f.cfm[key] = c
+	}
+	return c
+}
+
+// account returns the CloudFormation backend of an account in the home region.
+func (f *fakeClients) account(id string) *fakeaws.CloudFormation {
+	return f.region(id, testConfig.Region)
+}
+
+// region returns the CloudFormation backend of an account in a region.
+func (f *fakeClients) region(id, region string) *fakeaws.CloudFormation {
+	return f.stacks(testConfig.accountRoleARN(id), region)
+}
+
+// setupTest runs the test in a temporary directory holding organization.yaml and the
+// policy template, with the AWS clients served by in-memory fakes.
+func setupTest(t *testing.T, org Organization) *fakeClients {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "policies"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "policies", "template_policy.json"), []byte(testTemplate), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeOrgYaml(org)
+
+	fake := &fakeClients{org: fakeaws.NewOrganizations(), s3: fakeaws.NewS3(), cfm: make(map[string]*fakeaws.CloudFormation)}
+	prevClients, prevInterval, prevBackoff := clients, accountStatusPollInterval, moveAccountBackoff
+	prevStdin, prevInteractive, prevStackPoll := stdin, isInteractive, stackPollInterval
+	clients, accountStatusPollInterval, moveAccountBackoff, stackPollInterval = fake, 0, 0, 0
+	stdin, isInteractive = strings.NewReader(""), func() bool { return false }
+	t.Cleanup(func() {
+		clients, accountStatusPollInterval, moveAccountBackoff = prevClients, prevInterval, prevBackoff
+		stdin, isInteractive, stackPollInterval = prevStdin, prevInteractive, prevStackPoll
+		_ = os.Chdir(wd)
+	})
+	return fake
+}
+
+// writeTemplate writes a policy template file in the test directory.
+func writeTemplate(t *testing.T, name string) string {
+	t.Helper()
+	path := filepath.Join("policies", name)
+	if err := ioutil.WriteFile(path, []byte(testTemplate), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeLargeTemplate writes a policy template file over the inline size limit in the test directory.
+func writeLargeTemplate(t *testing.T, name string) string {
+	t.Helper()
+	path := filepath.Join("policies", name)
+	padding := strings.Repeat(" ", maxTemplateBodySize)
+	if err := ioutil.WriteFile(path, []byte(testTemplate+padding), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// captureStdout returns what f prints on the standard output.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		done <- string(b)
+	}()
+	prev := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = prev }()
+	f()
+	os.Stdout = prev
+	w.Close()
+	return <-done
+}
+
+func mustMarshal(t *testing.T, v interface{}) string {
+	t.Helper()
+	b, err := yaml.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestReadWriteOrgYaml(t *testing.T) {
+	org := Organization{
+		Accounts: []Account{{ID: "100000000001", Alias: "master", Email: "master@example.com"}},
+		OrganizationalUnits: []OrganizationalUnit{{
+			ID:   "ou-1",
+			Name: "Workloads",
+			OrganizationalUnits: []OrganizationalUnit{{
+				ID:       "ou-2",
+				Name:     "Prod",
+				Accounts: []Account{{ID: "100000000002", Alias: "prod", Email: "prod@example.com", TemplateFile: "policies/Prod-Policies"}},
+			}},
+		}},
+	}
+	setupTest(t, org)
+	if got, want := mustMarshal(t, readOrgYaml()), mustMarshal(t, org); got != want {
+		t.Errorf("organization.yaml round trip:\n%s\nwant:\n%s", got, want)
+	}
+}
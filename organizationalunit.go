@@ -5,53 +5,38 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/organizations"
 	"log"
+	"sort"
+	"strings"
 )
 
 func createOrganizationalUnit(ou OrganizationalUnit) error {
 
-	var ouParentId string
 	orgC := makeOrgClient(profile, orgRole)
 
-	// TODO: Add support for creating OU at any level
-	rootExists := false
-	Lro, err := orgC.ListRoots(&organizations.ListRootsInput{})
+	live, err := loadLiveOrganization(orgC)
 	if err != nil {
-		return fmt.Errorf("ERROR: Failed to list roots in organization")
+		return err
 	}
 
-	if ou.parent == "" {
-		rootExists = true
-		ouParentId = *Lro.Roots[0].Id
-	} else {
-		for _, root := range Lro.Roots {
-			if ou.parent == *root.Name {
-				ouParentId = *root.Id
-				rootExists = true
-			}
-		}
-	}
-
-	if !rootExists {
-		return fmt.Errorf("ERROR: Parent organizational unit %s does not exist.\n", ou.parent)
+	if ou.parent == live.Root.Name {
+		ou.parent = ""
 	}
-
-	listOrganizationalUnitsResult, err := orgC.ListOrganizationalUnitsForParent(&organizations.ListOrganizationalUnitsForParentInput{
-		ParentId: aws.String(ouParentId),
-	})
+	livePaths := live.paths()
+	parentPath, err := resolveOUPath(mapKeys(livePaths), ou.parent)
 	if err != nil {
-		log.Printf("ERROR: Failed to list the organizational units under master with: %v", err)
+		return fmt.Errorf("ERROR: Parent organizational unit could not be resolved: %v", err)
 	}
+	ou.parent = parentPath
+	parent := livePaths[parentPath]
 
-	for _, eOrganizationalUnit := range listOrganizationalUnitsResult.OrganizationalUnits {
-		if ou.Name == *eOrganizationalUnit.Name {
-			log.Printf("INFO: organizational unit %s already exists", ou.Name)
-			return nil
-		}
+	if parent.child(ou.Name) != nil {
+		log.Printf("INFO: organizational unit %s already exists", ou.Name)
+		return nil
 	}
 
 	orgUnitInput := &organizations.CreateOrganizationalUnitInput{
 		Name:     aws.String(ou.Name),
-		ParentId: aws.String(ouParentId),
+		ParentId: aws.String(parent.ID),
 	}
 
 	orgUnitOutput, err := orgC.CreateOrganizationalUnit(orgUnitInput)
@@ -64,3 +49,121 @@ func createOrganizationalUnit(ou OrganizationalUnit) error {
 	updateOrgYaml(ou)
 	return nil
 }
+
+// walkOrganizationalUnits calls fn for every OU in the tree, parents before children,
+// together with the slash-separated path of the OU from the root.
+func walkOrganizationalUnits(ous []OrganizationalUnit, parentPath string, fn func(path string, ou *OrganizationalUnit)) {
+	for i := range ous {
+		path := ous[i].Name
+		if parentPath != "" {
+			path = parentPath + "/" + path
+		}
+		fn(path, &ous[i])
+		walkOrganizationalUnits(ous[i].OrganizationalUnits, path, fn)
+	}
+}
+
+// accountAncestors returns the OUs containing the account, from the top of the tree down to its OU.
+func accountAncestors(ous []OrganizationalUnit, alias string) []OrganizationalUnit {
+	for _, ou := range ous {
+		for _, a := range ou.Accounts {
+			if a.Alias == alias {
+				return []OrganizationalUnit{ou}
+			}
+		}
+		if chain := accountAncestors(ou.OrganizationalUnits, alias); chain != nil {
+			return append([]OrganizationalUnit{ou}, chain...)
+		}
+	}
+	return nil
+}
+
+// organizationalUnitPaths returns the paths of every OU in the tree.
+func organizationalUnitPaths(ous []OrganizationalUnit) []string {
+	var paths []string
+	walkOrganizationalUnits(ous, "", func(path string, ou *OrganizationalUnit) {
+		paths = append(paths, path)
+	})
+	return paths
+}
+
+// findOrganizationalUnit returns the OU at the given path, or nil.
+func findOrganizationalUnit(ous []OrganizationalUnit, path string) *OrganizationalUnit {
+	var found *OrganizationalUnit
+	walkOrganizationalUnits(ous, "", func(p string, ou *OrganizationalUnit) {
+		if found == nil && p == path {
+			found = ou
+		}
+	})
+	return found
+}
+
+// ensureOrganizationalUnitPath returns the OU of organization.yaml at a path, adding the OUs of the
+// path that are missing from the file. The added OUs have no ID yet, apply records it.
+func ensureOrganizationalUnitPath(org *Organization, path string) *OrganizationalUnit {
+	ous := &org.OrganizationalUnits
+	var ou *OrganizationalUnit
+	for _, name := range strings.Split(path, "/") {
+		ou = nil
+		for i := range *ous {
+			if (*ous)[i].Name == name {
+				ou = &(*ous)[i]
+			}
+		}
+		if ou == nil {
+			*ous = append(*ous, OrganizationalUnit{Name: name})
+			ou = &(*ous)[len(*ous)-1]
+		}
+		ous = &ou.OrganizationalUnits
+	}
+	return ou
+}
+
+// resolveOUPath resolves a slash-separated OU path, like Workloads/Prod/Data, against the known
+// paths of a tree and returns the matching path. A single segment may name an OU at any depth
+// as long as the name is unique. The empty path is the root.
+func resolveOUPath(paths []string, path string) (string, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return "", nil
+	}
+	known := make(map[string]bool)
+	for _, p := range paths {
+		known[p] = true
+	}
+	if known[path] {
+		return path, nil
+	}
+	segments := strings.Split(path, "/")
+	if len(segments) > 1 {
+		for i := range segments {
+			if !known[strings.Join(segments[:i+1], "/")] {
+				return "", fmt.Errorf("organizational unit %s does not exist under %s", segments[i], displayOUPath(strings.Join(segments[:i], "/")))
+			}
+		}
+	}
+	var matches []string
+	for _, p := range paths {
+		if _, name := splitOUPath(p); name == path {
+			matches = append(matches, p)
+		}
+	}
+	sort.Strings(matches)
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("organizational unit %s does not exist", path)
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("organizational unit %s is ambiguous, use one of: %s", path, strings.Join(matches, ", "))
+}
+
+func mapKeys(m map[string]*liveOU) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
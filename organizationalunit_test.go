@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCreateOrganizationalUnit(t *testing.T) {
+	fake := setupTest(t, Organization{})
+
+	if err := createOrganizationalUnit(OrganizationalUnit{Name: "Workloads"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := createOrganizationalUnit(OrganizationalUnit{Name: "Prod", parent: "Workloads"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := createOrganizationalUnit(OrganizationalUnit{Name: "Data", parent: "Workloads/Prod"}); err != nil {
+		t.Fatal(err)
+	}
+	// Creating an existing OU is a no-op.
+	if err := createOrganizationalUnit(OrganizationalUnit{Name: "Prod", parent: "Workloads"}); err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := loadLiveOrganization(fake.org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := live.paths()["Workloads/Prod/Data"]
+	if data == nil {
+		t.Fatalf("Workloads/Prod/Data was not created, have %v", mapKeys(live.paths()))
+	}
+	if len(live.Root.OUs) != 1 || len(live.Root.OUs[0].OUs) != 1 {
+		t.Errorf("unexpected tree %v", mapKeys(live.paths()))
+	}
+
+	org := readOrgYaml()
+	if got := organizationalUnitPaths(org.OrganizationalUnits); strings.Join(got, ",") != "Workloads,Workloads/Prod,Workloads/Prod/Data" {
+		t.Errorf("organization.yaml paths = %v", got)
+	}
+	if ou := findOrganizationalUnit(org.OrganizationalUnits, "Workloads/Prod/Data"); ou == nil || ou.ID != data.ID {
+		t.Errorf("organization.yaml entry = %+v, want ID %s", ou, data.ID)
+	}
+}
+
+func TestCreateOrganizationalUnitMissingParent(t *testing.T) {
+	setupTest(t, Organization{})
+	err := createOrganizationalUnit(OrganizationalUnit{Name: "Data", parent: "Workloads/Prod"})
+	if err == nil || !strings.Contains(err.Error(), "Workloads does not exist") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestCreateOrganizationalUnitParentNotInYaml(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	workloads := fake.org.AddOU(fake.org.RootID(), "Workloads")
+	fake.org.AddOU(workloads, "Prod")
+
+	if err := createOrganizationalUnit(OrganizationalUnit{Name: "Data", parent: "Workloads/Prod"}); err != nil {
+		t.Fatal(err)
+	}
+	org := readOrgYaml()
+	if got := organizationalUnitPaths(org.OrganizationalUnits); strings.Join(got, ",") != "Workloads,Workloads/Prod,Workloads/Prod/Data" {
+		t.Errorf("organization.yaml paths = %v", got)
+	}
+	live, err := loadLiveOrganization(fake.org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions := makePlan(org, live); len(actions) != 0 {
+		t.Errorf("plan after create-ou = %v", actions)
+	}
+}
+
+func TestResolveOUPath(t *testing.T) {
+	paths := []string{"Workloads", "Workloads/Prod", "Workloads/Prod/Data", "Sandbox", "Sandbox/Prod"}
+	tests := []struct {
+		path, want, err string
+	}{
+		{path: "", want: ""},
+		{path: "Workloads/Prod", want: "Workloads/Prod"},
+		{path: "/Workloads/Prod/", want: "Workloads/Prod"},
+		{path: "Data", want: "Workloads/Prod/Data"},
+		{path: "Prod", err: "ambiguous"},
+		{path: "Workloads/Dev/Data", err: "Dev does not exist under Workloads"},
+		{path: "Security", err: "Security does not exist"},
+	}
+	for _, tt := range tests {
+		got, err := resolveOUPath(paths, tt.path)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("resolveOUPath(%q) error = %v, want %q", tt.path, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("resolveOUPath(%q) = %q, %v, want %q", tt.path, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	cli "github.com/urfave/cli/v2"
+	"log"
+	"strings"
+)
+
+const (
+	actionCreateOU      = "create-ou"
+	actionCreateAccount = "create-account"
+	actionMoveAccount   = "move-account"
+)
+
+// planAction is a single change needed to converge the live organization to organization.yaml.
+type planAction struct {
+	Kind           string
+	OU             string
+	Account        Account
+	SourceParentID string
+}
+
+func (a planAction) String() string {
+	switch a.Kind {
+	case actionCreateOU:
+		return fmt.Sprintf("+ create organizational unit %s", a.OU)
+	case actionCreateAccount:
+		return fmt.Sprintf("+ create account %s <%s> in %s", a.Account.Alias, a.Account.Email, displayOUPath(a.OU))
+	case actionMoveAccount:
+		if a.Account.State == accountStatePendingMove {
+			return fmt.Sprintf("~ move account %s (%s) from %s to %s (%s)", a.Account.Alias, a.Account.ID, a.SourceParentID, displayOUPath(a.OU), accountStatePendingMove)
+		}
+		return fmt.Sprintf("~ move account %s (%s) from %s to %s", a.Account.Alias, a.Account.ID, a.SourceParentID, displayOUPath(a.OU))
+	}
+	return a.Kind
+}
+
+// splitOUPath splits an OU path into the path of its parent and its own name.
+func splitOUPath(path string) (string, string) {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return "", path
+}
+
+func displayOUPath(path string) string {
+	if path == "" {
+		return "the root"
+	}
+	return path
+}
+
+// makePlan compares organization.yaml with the live organization and returns the actions to apply.
+// OUs are identified by their path from the root, the root itself being the empty path.
+func makePlan(org Organization, live *liveOrganization) []planAction {
+	var ouActions, accActions []planAction
+	livePaths := live.paths()
+	planAccounts := func(path string, accounts []Account) {
+		lou := livePaths[path]
+		for _, acc := range accounts {
+			la, parentID := live.findAccount(acc.ID, acc.Alias)
+			if la == nil {
+				accActions = append(accActions, planAction{Kind: actionCreateAccount, OU: path, Account: acc})
+				continue
+			}
+			acc.ID = *la.Id
+			if lou == nil || parentID != lou.ID {
+				accActions = append(accActions, planAction{Kind: actionMoveAccount, OU: path, Account: acc, SourceParentID: parentID})
+			}
+		}
+	}
+	planAccounts("", org.Accounts)
+	walkOrganizationalUnits(org.OrganizationalUnits, "", func(path string, ou *OrganizationalUnit) {
+		if livePaths[path] == nil {
+			ouActions = append(ouActions, planAction{Kind: actionCreateOU, OU: path})
+		}
+		planAccounts(path, ou.Accounts)
+	})
+	return append(ouActions, accActions...)
+}
+
+func printPlan(actions []planAction) {
+	if len(actions) == 0 {
+		log.Println("INFO: No changes. The organization matches organization.yaml")
+		return
+	}
+	for _, a := range actions {
+		fmt.Println(a)
+	}
+	fmt.Printf("Plan: %d change(s)\n", len(actions))
+}
+
+// Plan prints the changes apply would make to converge the organization to organization.yaml.
+func Plan(ctx *cli.Context) error {
+	org := readOrgYaml()
+	orgC := makeOrgClient(profile, orgRole)
+	live, err := loadLiveOrganization(orgC)
+	if err != nil {
+		return err
+	}
+	printPlan(makePlan(org, live))
+	return nil
+}
+
+// Apply executes the plan and records the resulting IDs in organization.yaml.
+func Apply(ctx *cli.Context) error {
+	org := readOrgYaml()
+	orgC := makeOrgClient(profile, orgRole)
+	live, err := loadLiveOrganization(orgC)
+	if err != nil {
+		return err
+	}
+	actions := makePlan(org, live)
+	printPlan(actions)
+
+	ouIDs := make(map[string]string)
+	for path, u := range live.paths() {
+		ouIDs[path] = u.ID
+	}
+	accIDs := make(map[string]string)
+	for _, a := range actions {
+		switch a.Kind {
+		case actionCreateOU:
+			parent, name := splitOUPath(a.OU)
+			out, err := orgC.CreateOrganizationalUnit(&organizations.CreateOrganizationalUnitInput{
+				Name:     aws.String(name),
+				ParentId: aws.String(ouIDs[parent]),
+			})
+			if err != nil {
+				return fmt.Errorf("ERROR: Failed to create organizational unit %s with: %v", a.OU, err)
+			}
+			ouIDs[a.OU] = *out.OrganizationalUnit.Id
+			log.Printf("INFO: organizational unit %s created successfully with ID %s.\n", a.OU, ouIDs[a.OU])
+		case actionCreateAccount:
+			out, err := orgC.CreateAccount(&organizations.CreateAccountInput{
+				AccountName:            aws.String(a.Account.Alias),
+				Email:                  aws.String(a.Account.Email),
+				IamUserAccessToBilling: aws.String(iamUserBillingAccess),
+			})
+			if err != nil {
+				return fmt.Errorf("ERROR: Account %s creation failed with: %v", a.Account.Alias, err)
+			}
+			accID, err := waitForAccountCreation(orgC, a.Account.Alias, out.CreateAccountStatus.Id)
+			if err != nil {
+				return err
+			}
+			accIDs[a.Account.Alias] = accID
+			// New accounts are created under the root, the accounts of the root stay there.
+			if a.OU == "" {
+				continue
+			}
+			err = moveAccount(orgC, accID, live.Root.ID, ouIDs[a.OU])
+			if err != nil {
+				return fmt.Errorf("ERROR: Failed to move the account %s to the destination organizational unit %s", a.Account.Alias, displayOUPath(a.OU))
+			}
+		case actionMoveAccount:
+			accIDs[a.Account.Alias] = a.Account.ID
+			err := moveAccount(orgC, a.Account.ID, a.SourceParentID, ouIDs[a.OU])
+			if err != nil {
+				return fmt.Errorf("ERROR: Failed to move the account %s to the destination organizational unit %s", a.Account.Alias, displayOUPath(a.OU))
+			}
+			log.Printf("INFO: Account %s moved to %s", a.Account.Alias, displayOUPath(a.OU))
+		}
+	}
+
+	recordIDs := func(accounts []Account) {
+		for j, acc := range accounts {
+			if id, ok := accIDs[acc.Alias]; ok {
+				accounts[j].ID = id
+				accounts[j].State = ""
+			} else if la, _ := live.findAccount(acc.ID, acc.Alias); la != nil {
+				accounts[j].ID = *la.Id
+				accounts[j].State = ""
+			}
+		}
+	}
+	recordIDs(org.Accounts)
+	walkOrganizationalUnits(org.OrganizationalUnits, "", func(path string, ou *OrganizationalUnit) {
+		ou.ID = ouIDs[path]
+		recordIDs(ou.Accounts)
+	})
+	writeOrgYaml(org)
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMakePlan(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	workloads := fake.org.AddOU(fake.org.RootID(), "Workloads")
+	stray := fake.org.AddAccount(fake.org.RootID(), "stray", "stray@example.com")
+	fake.org.AddAccount(workloads, "placed", "placed@example.com")
+
+	org := Organization{OrganizationalUnits: []OrganizationalUnit{{
+		Name: "Workloads",
+		Accounts: []Account{
+			{Alias: "placed", Email: "placed@example.com"},
+		},
+		OrganizationalUnits: []OrganizationalUnit{{
+			Name: "Prod",
+			Accounts: []Account{
+				{Alias: "stray", Email: "stray@example.com"},
+				{Alias: "data", Email: "data@example.com"},
+			},
+		}},
+	}}}
+	live, err := loadLiveOrganization(fake.org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, a := range makePlan(org, live) {
+		got = append(got, a.String())
+	}
+	want := []string{
+		"+ create organizational unit Workloads/Prod",
+		"~ move account stray (" + stray + ") from r-root to Workloads/Prod",
+		"+ create account data <data@example.com> in Workloads/Prod",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("plan = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("plan[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	fake := setupTest(t, Organization{Accounts: []Account{{Alias: "audit", Email: "audit@example.com"}}, OrganizationalUnits: []OrganizationalUnit{{
+		Name: "Workloads",
+		OrganizationalUnits: []OrganizationalUnit{{
+			Name:     "Prod",
+			Accounts: []Account{{Alias: "data", Email: "data@example.com"}},
+		}},
+	}}})
+
+	if err := Apply(nil); err != nil {
+		t.Fatal(err)
+	}
+	live, err := loadLiveOrganization(fake.org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions := makePlan(readOrgYaml(), live); len(actions) != 0 {
+		t.Errorf("plan after apply = %v", actions)
+	}
+	ou := findOrganizationalUnit(readOrgYaml().OrganizationalUnits, "Workloads/Prod")
+	prod := live.paths()["Workloads/Prod"]
+	if ou.ID != prod.ID || len(ou.Accounts) != 1 || ou.Accounts[0].ID != *prod.Accounts[0].Id {
+		t.Errorf("organization.yaml Workloads/Prod = %+v", ou)
+	}
+	if audit := readOrgYaml().Accounts; len(audit) != 1 || audit[0].ID == "" || len(live.Root.Accounts) != 1 {
+		t.Errorf("organization.yaml root accounts = %+v, live root accounts = %v", audit, live.Root.Accounts)
+	}
+}
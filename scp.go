@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/organizations/organizationsiface"
+	cli "github.com/urfave/cli/v2"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+)
+
+// scpDir holds the service control policy documents, policies/scp/<name>.json for the SCP <name>.
+const scpDir = "policies/scp"
+
+// scpManagedDescription is the description of the SCPs created by the tool. Only those are updated
+// and detached, FullAWSAccess and the policies created by hand are left alone.
+const scpManagedDescription = "Managed by org-governor"
+
+const (
+	actionCreatePolicy = "create-policy"
+	actionUpdatePolicy = "update-policy"
+	actionAttachPolicy = "attach-policy"
+	actionDetachPolicy = "detach-policy"
+)
+
+// scpAction is a single change needed to converge the SCPs to organization.yaml.
+type scpAction struct {
+	Kind     string
+	Policy   string
+	PolicyID string
+	Content  string
+	TargetID string
+	Target   string
+}
+
+func (a scpAction) String() string {
+	switch a.Kind {
+	case actionCreatePolicy:
+		return fmt.Sprintf("+ create policy %s", a.Policy)
+	case actionUpdatePolicy:
+		return fmt.Sprintf("~ update policy %s", a.Policy)
+	case actionAttachPolicy:
+		return fmt.Sprintf("+ attach policy %s to %s", a.Policy, a.Target)
+	case actionDetachPolicy:
+		return fmt.Sprintf("- detach policy %s from %s", a.Policy, a.Target)
+	}
+	return a.Kind
+}
+
+// scpTarget is the root, an OU or an account an SCP is attached to.
+type scpTarget struct {
+	ID   string
+	Name string
+}
+
+// desiredSCPs returns the targets organization.yaml attaches every SCP to. The OUs and accounts
+// that do not exist yet are returned as missing, apply creates them.
+func desiredSCPs(org Organization, live *liveOrganization) (map[string][]scpTarget, []string) {
+	desired := make(map[string][]scpTarget)
+	var missing []string
+	attach := func(names []string, target scpTarget) {
+		for _, name := range names {
+			desired[name] = append(desired[name], target)
+		}
+	}
+	attachAccounts := func(accounts []Account) {
+		for _, a := range accounts {
+			if len(a.SCPs) == 0 {
+				continue
+			}
+			la, _ := live.findAccount(a.ID, a.Alias)
+			if la == nil {
+				missing = append(missing, "account "+a.Alias)
+				continue
+			}
+			attach(a.SCPs, scpTarget{ID: *la.Id, Name: a.Alias})
+		}
+	}
+	attach(org.SCPs, scpTarget{ID: live.Root.ID, Name: displayOUPath("")})
+	attachAccounts(org.Accounts)
+	livePaths := live.paths()
+	walkOrganizationalUnits(org.OrganizationalUnits, "", func(path string, ou *OrganizationalUnit) {
+		if lou := livePaths[path]; lou != nil {
+			attach(ou.SCPs, scpTarget{ID: lou.ID, Name: path})
+		} else if len(ou.SCPs) > 0 {
+			missing = append(missing, "organizational unit "+path)
+		}
+		attachAccounts(ou.Accounts)
+	})
+	return desired, missing
+}
+
+// readSCP reads the document of an SCP, compacted to make the most of the policy size limit.
+func readSCP(name string) (string, error) {
+	file := filepath.Join(scpDir, name+".json")
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("ERROR: Failed to read the document of the SCP %s: %v", name, err)
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, content); err != nil {
+		return "", fmt.Errorf("ERROR: SCP document %s is not valid JSON: %v", file, err)
+	}
+	return compact.String(), nil
+}
+
+// planSCPs compares the SCPs of organization.yaml with the live organization and returns the
+// actions to apply: policies to create or update first, then attachments, then detachments, so a
+// target is never left without a guardrail in between. The managed SCPs are detached from every
+// target organization.yaml does not attach them to.
+func planSCPs(orgC organizationsiface.OrganizationsAPI, org Organization, live *liveOrganization) ([]scpAction, []string, error) {
+	desired, missing := desiredSCPs(org, live)
+	existing := make(map[string]*organizations.PolicySummary)
+	err := orgC.ListPoliciesPages(&organizations.ListPoliciesInput{Filter: aws.String(organizations.PolicyTypeServiceControlPolicy)},
+		func(page *organizations.ListPoliciesOutput, lastPage bool) bool {
+			for _, p := range page.Policies {
+				existing[*p.Name] = p
+			}
+			return true
+		})
+	if err != nil {
+		return nil, nil, fmt.Errorf("ERROR: Failed to list the service control policies: %v", err)
+	}
+	managed := func(p *organizations.PolicySummary) bool {
+		return !aws.BoolValue(p.AwsManaged) && aws.StringValue(p.Description) == scpManagedDescription
+	}
+
+	var names []string
+	for name := range desired {
+		names = append(names, name)
+	}
+	for name, p := range existing {
+		if _, ok := desired[name]; !ok && managed(p) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var policies, attachments, detachments []scpAction
+	for _, name := range names {
+		p := existing[name]
+		targets, listed := desired[name]
+		if listed {
+			content, err := readSCP(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch {
+			case p == nil:
+				policies = append(policies, scpAction{Kind: actionCreatePolicy, Policy: name, Content: content})
+			case !managed(p):
+				return nil, nil, fmt.Errorf("ERROR: SCP %s already exists and is not managed by the governor, rename its document", name)
+			default:
+				out, err := orgC.DescribePolicy(&organizations.DescribePolicyInput{PolicyId: p.Id})
+				if err != nil {
+					return nil, nil, fmt.Errorf("ERROR: Failed to describe the SCP %s: %v", name, err)
+				}
+				if aws.StringValue(out.Policy.Content) != content {
+					policies = append(policies, scpAction{Kind: actionUpdatePolicy, Policy: name, PolicyID: *p.Id, Content: content})
+				}
+			}
+		}
+
+		current := make(map[string]string)
+		if p != nil {
+			err := orgC.ListTargetsForPolicyPages(&organizations.ListTargetsForPolicyInput{PolicyId: p.Id},
+				func(page *organizations.ListTargetsForPolicyOutput, lastPage bool) bool {
+					for _, t := range page.Targets {
+						current[*t.TargetId] = aws.StringValue(t.Name)
+					}
+					return true
+				})
+			if err != nil {
+				return nil, nil, fmt.Errorf("ERROR: Failed to list the targets of the SCP %s: %v", name, err)
+			}
+		}
+		policyID := ""
+		if p != nil {
+			policyID = *p.Id
+		}
+		wanted := make(map[string]bool)
+		for _, t := range targets {
+			if wanted[t.ID] {
+				continue
+			}
+			wanted[t.ID] = true
+			if _, ok := current[t.ID]; !ok {
+				attachments = append(attachments, scpAction{Kind: actionAttachPolicy, Policy: name, PolicyID: policyID, TargetID: t.ID, Target: t.Name})
+			}
+		}
+		var stale []string
+		for id := range current {
+			if !wanted[id] {
+				stale = append(stale, id)
+			}
+		}
+		sort.Strings(stale)
+		for _, id := range stale {
+			detachments = append(detachments, scpAction{Kind: actionDetachPolicy, Policy: name, PolicyID: policyID, TargetID: id, Target: current[id]})
+		}
+	}
+	return append(append(policies, attachments...), detachments...), missing, nil
+}
+
+// applySCPs executes the SCP actions in order.
+func applySCPs(orgC organizationsiface.OrganizationsAPI, actions []scpAction) error {
+	created := make(map[string]string)
+	for _, a := range actions {
+		if a.PolicyID == "" {
+			a.PolicyID = created[a.Policy]
+		}
+		switch a.Kind {
+		case actionCreatePolicy:
+			out, err := orgC.CreatePolicy(&organizations.CreatePolicyInput{
+				Name:        aws.String(a.Policy),
+				Description: aws.String(scpManagedDescription),
+				Type:        aws.String(organizations.PolicyTypeServiceControlPolicy),
+				Content:     aws.String(a.Content),
+			})
+			if err != nil {
+				return fmt.Errorf("ERROR: Failed to create the SCP %s with: %v", a.Policy, err)
+			}
+			created[a.Policy] = *out.Policy.PolicySummary.Id
+			log.Printf("INFO: SCP %s created with ID %s", a.Policy, created[a.Policy])
+		case actionUpdatePolicy:
+			_, err := orgC.UpdatePolicy(&organizations.UpdatePolicyInput{PolicyId: aws.String(a.PolicyID), Content: aws.String(a.Content)})
+			if err != nil {
+				return fmt.Errorf("ERROR: Failed to update the SCP %s with: %v", a.Policy, err)
+			}
+			log.Printf("INFO: SCP %s updated", a.Policy)
+		case actionAttachPolicy:
+			_, err := orgC.AttachPolicy(&organizations.AttachPolicyInput{PolicyId: aws.String(a.PolicyID), TargetId: aws.String(a.TargetID)})
+			if err != nil {
+				return fmt.Errorf("ERROR: Failed to attach the SCP %s to %s with: %v", a.Policy, a.Target, err)
+			}
+			log.Printf("INFO: SCP %s attached to %s", a.Policy, a.Target)
+		case actionDetachPolicy:
+			_, err := orgC.DetachPolicy(&organizations.DetachPolicyInput{PolicyId: aws.String(a.PolicyID), TargetId: aws.String(a.TargetID)})
+			if err != nil {
+				return fmt.Errorf("ERROR: Failed to detach the SCP %s from %s with: %v", a.Policy, a.Target, err)
+			}
+			log.Printf("INFO: SCP %s detached from %s", a.Policy, a.Target)
+		}
+	}
+	return nil
+}
+
+// SyncSCPs creates and updates the SCPs referenced in organization.yaml and attaches them to their
+// targets, detaching them from the targets that no longer list them. With --dry-run, the actions
+// are only printed.
+func SyncSCPs(ctx *cli.Context) error {
+	return syncSCPs(ctx.Bool("dry-run"))
+}
+
+func syncSCPs(dryRun bool) error {
+	org := readOrgYaml()
+	orgC := makeOrgClient(profile, orgRole)
+	live, err := loadLiveOrganization(orgC)
+	if err != nil {
+		return err
+	}
+	actions, missing, err := planSCPs(orgC, org, live)
+	if err != nil {
+		return err
+	}
+	for _, m := range missing {
+		log.Printf("INFO: The SCPs of %s are skipped, it does not exist yet. Run apply first", m)
+	}
+	if len(actions) == 0 {
+		log.Println("INFO: No changes. The SCPs match organization.yaml")
+		return nil
+	}
+	for _, a := range actions {
+		fmt.Println(a)
+	}
+	fmt.Printf("Plan: %d SCP change(s)\n", len(actions))
+	if dryRun {
+		return nil
+	}
+	return applySCPs(orgC, actions)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const denyLeaveSCP = `{
+  "Version": "2012-10-17",
+  "Statement": [{"Effect": "Deny", "Action": "organizations:LeaveOrganization", "Resource": "*"}]
+}
+`
+
+const regionLockSCP = `{
+  "Version": "2012-10-17",
+  "Statement": [{"Effect": "Deny", "NotAction": "iam:*", "Resource": "*",
+    "Condition": {"StringNotEquals": {"aws:RequestedRegion": ["us-west-2"]}}}]
+}
+`
+
+// writeSCP writes an SCP document in the test directory.
+func writeSCP(t *testing.T, name, content string) {
+	t.Helper()
+	if err := os.MkdirAll(scpDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(scpDir, name+".json"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncSCPs(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	workloads := fake.org.AddOU(fake.org.RootID(), "Workloads")
+	devID := fake.org.AddAccount(workloads, "dev", "dev@example.com")
+	writeSCP(t, "deny-leave", denyLeaveSCP)
+	writeSCP(t, "region-lock", regionLockSCP)
+	org := Organization{SCPs: []string{"deny-leave"}, OrganizationalUnits: []OrganizationalUnit{{ID: workloads, Name: "Workloads", SCPs: []string{"region-lock"},
+		Accounts:            []Account{{ID: devID, Alias: "dev", Email: "dev@example.com", SCPs: []string{"region-lock"}}},
+		OrganizationalUnits: []OrganizationalUnit{{Name: "Sandbox", SCPs: []string{"deny-leave"}}},
+	}}}
+	writeOrgYaml(org)
+
+	if err := syncSCPs(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.org.PolicyContent("deny-leave"); ok {
+		t.Fatal("the dry run created a policy")
+	}
+
+	if err := syncSCPs(false); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := fake.org.PolicyContent("deny-leave"); !strings.HasPrefix(content, `{"Version":"2012-10-17","Statement":[{"Effect":"Deny"`) {
+		t.Errorf("deny-leave content = %s", content)
+	}
+	if got := fake.org.PolicyTargets("deny-leave"); !reflect.DeepEqual(got, []string{fake.org.RootID()}) {
+		t.Errorf("deny-leave targets = %v, the Sandbox OU does not exist yet", got)
+	}
+	if got, want := fake.org.PolicyTargets("region-lock"), []string{devID, workloads}; !reflect.DeepEqual(got, want) {
+		t.Errorf("region-lock targets = %v, want %v", got, want)
+	}
+
+	live, err := loadLiveOrganization(fake.org)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actions, _, err := planSCPs(fake.org, org, live); err != nil || len(actions) != 0 {
+		t.Errorf("actions after sync = %v, %v", actions, err)
+	}
+
+	// The document changes and dev no longer lists region-lock.
+	writeSCP(t, "region-lock", strings.Replace(regionLockSCP, "us-west-2", "eu-west-1", 1))
+	org.OrganizationalUnits[0].Accounts[0].SCPs = nil
+	writeOrgYaml(org)
+	actions, _, err := planSCPs(fake.org, org, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, a := range actions {
+		got = append(got, a.String())
+	}
+	want := []string{"~ update policy region-lock", "- detach policy region-lock from dev"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("actions = %q, want %q", got, want)
+	}
+	if err := syncSCPs(false); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := fake.org.PolicyContent("region-lock"); !strings.Contains(content, "eu-west-1") {
+		t.Errorf("region-lock content = %s", content)
+	}
+	if got := fake.org.PolicyTargets("region-lock"); !reflect.DeepEqual(got, []string{workloads}) {
+		t.Errorf("region-lock targets = %v", got)
+	}
+	if got := fake.org.PolicyTargets("FullAWSAccess"); !reflect.DeepEqual(got, []string{fake.org.RootID()}) {
+		t.Errorf("FullAWSAccess targets = %v, it is not managed by the governor", got)
+	}
+
+	// A policy no longer referenced anywhere is detached everywhere but kept.
+	org.SCPs = nil
+	org.OrganizationalUnits[0].OrganizationalUnits = nil
+	writeOrgYaml(org)
+	if err := syncSCPs(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.org.PolicyContent("deny-leave"); !ok || len(fake.org.PolicyTargets("deny-leave")) != 0 {
+		t.Errorf("deny-leave targets = %v", fake.org.PolicyTargets("deny-leave"))
+	}
+}
+
+func TestSyncSCPsErrors(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	writeOrgYaml(Organization{SCPs: []string{"missing"}})
+	if err := syncSCPs(false); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("err = %v", err)
+	}
+
+	writeSCP(t, "deny-leave", denyLeaveSCP)
+	if _, err := fake.org.CreatePolicy(&organizations.CreatePolicyInput{
+		Name:    aws.String("deny-leave"),
+		Type:    aws.String(organizations.PolicyTypeServiceControlPolicy),
+		Content: aws.String(denyLeaveSCP),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	writeOrgYaml(Organization{SCPs: []string{"deny-leave"}})
+	if err := syncSCPs(false); err == nil || !strings.Contains(err.Error(), "not managed") {
+		t.Errorf("err = %v", err)
+	}
+
+	writeSCP(t, "broken", "{")
+	writeOrgYaml(Organization{SCPs: []string{"broken"}})
+	if err := syncSCPs(false); err == nil || !strings.Contains(err.Error(), "not valid JSON") {
+		t.Errorf("err = %v", err)
+	}
+}
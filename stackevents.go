@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	cfm "github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"log"
+	"strings"
+	"time"
+)
+
+// stackEventPollInterval is the wait between two reads of the events of a stack during an operation.
+var stackEventPollInterval = 5 * time.Second
+
+// stackEventTail follows the events of a stack from the moment it is started.
+type stackEventTail struct {
+	cfmC cloudformationiface.CloudFormationAPI
+	// name identifies the account and region in the logs.
+	name      string
+	stackName string
+	seen      map[string]bool
+	// events are the events read so far, the oldest first.
+	events []*cfm.StackEvent
+}
+
+// newStackEventTail starts following the events of a stack after its most recent event.
+func newStackEventTail(cfmC cloudformationiface.CloudFormationAPI, name, stackName string) *stackEventTail {
+	t := &stackEventTail{cfmC: cfmC, name: name, stackName: stackName, seen: make(map[string]bool)}
+	out, err := cfmC.DescribeStackEvents(&cfm.DescribeStackEventsInput{StackName: aws.String(stackName)})
+	if err == nil {
+		for _, e := range out.StackEvents {
+			t.seen[aws.StringValue(e.EventId)] = true
+		}
+	}
+	return t
+}
+
+// poll logs the events that happened since the previous poll.
+func (t *stackEventTail) poll() {
+	var fresh []*cfm.StackEvent
+	err := t.cfmC.DescribeStackEventsPages(&cfm.DescribeStackEventsInput{StackName: aws.String(t.stackName)}, func(page *cfm.DescribeStackEventsOutput, last bool) bool {
+		for _, e := range page.StackEvents {
+			if t.seen[aws.StringValue(e.EventId)] {
+				return false
+			}
+			fresh = append(fresh, e)
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("INFO: %s: failed to read the stack events: %v", t.name, err)
+		return
+	}
+	// The events come the most recent first.
+	for i := len(fresh) - 1; i >= 0; i-- {
+		e := fresh[i]
+		t.seen[aws.StringValue(e.EventId)] = true
+		t.events = append(t.events, e)
+		reason := ""
+		if e.ResourceStatusReason != nil {
+			reason = " " + *e.ResourceStatusReason
+		}
+		log.Printf("INFO: %s: %s %s %s %s%s", t.name, aws.TimeValue(e.Timestamp).Format(time.RFC3339),
+			aws.StringValue(e.LogicalResourceId), aws.StringValue(e.ResourceType), aws.StringValue(e.ResourceStatus), reason)
+	}
+}
+
+// failure returns the first failed event with a reason, it names the resource that broke the operation.
+func (t *stackEventTail) failure() *cfm.StackEvent {
+	for _, e := range t.events {
+		if strings.HasSuffix(aws.StringValue(e.ResourceStatus), "_FAILED") && aws.StringValue(e.ResourceStatusReason) != "" {
+			return e
+		}
+	}
+	return nil
+}
+
+// wait runs the waiter of a stack operation, logging the stack events until it returns.
+// When the operation fails, the reason of the first failed event is added to the error.
+func (t *stackEventTail) wait(waiter func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- waiter()
+	}()
+	for {
+		select {
+		case err := <-done:
+			t.poll()
+			if err != nil {
+				if e := t.failure(); e != nil {
+					return fmt.Errorf("%v: %s %s: %s", err, aws.StringValue(e.LogicalResourceId), aws.StringValue(e.ResourceStatus), aws.StringValue(e.ResourceStatusReason))
+				}
+			}
+			return err
+		case <-time.After(stackEventPollInterval):
+			t.poll()
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/annemakhil/org-governor/fakeaws"
+	"github.com/aws/aws-sdk-go/aws"
+	cfm "github.com/aws/aws-sdk-go/service/cloudformation"
+	"strings"
+	"testing"
+)
+
+func TestExecutePolicyChangeSetFailureReason(t *testing.T) {
+	c := fakeaws.NewCloudFormation()
+	c.Failures["Dev-Policies"] = fakeaws.Failure{LogicalID: "DeveloperRole", ResourceType: "AWS::IAM::Role", Reason: "dev-role already exists"}
+	out, err := c.CreateChangeSet(&cfm.CreateChangeSetInput{
+		ChangeSetName: aws.String("cs-1"),
+		ChangeSetType: aws.String(cfm.ChangeSetTypeCreate),
+		StackName:     aws.String("Dev-Policies"),
+		TemplateURL:   aws.String("https://templates.s3-us-west-2.amazonaws.com/Dev-Policies"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = executePolicyChangeSet(c, "dev/us-west-2", "Dev-Policies", out.Id, outcomeCreated)
+	if err == nil || !strings.Contains(err.Error(), "DeveloperRole CREATE_FAILED: dev-role already exists") {
+		t.Errorf("err = %v", err)
+	}
+	if s := c.Stack("Dev-Policies"); s.Status != cfm.StackStatusRollbackComplete {
+		t.Errorf("stack status = %s", s.Status)
+	}
+}
+
+func TestStackEventTail(t *testing.T) {
+	c := fakeaws.NewCloudFormation()
+	c.EventPageSize = 2
+	c.PutStack(fakeaws.Stack{Name: "Dev-Policies", Status: cfm.StackStatusCreateComplete})
+	update := func(url string) {
+		t.Helper()
+		if _, err := c.UpdateStack(&cfm.UpdateStackInput{StackName: aws.String("Dev-Policies"), TemplateURL: aws.String(url)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update("v1")
+	update("v2")
+
+	tail := newStackEventTail(c, "dev/us-west-2", "Dev-Policies")
+	update("v3")
+	update("v4")
+	tail.poll()
+	var got []string
+	for _, e := range tail.events {
+		got = append(got, *e.ResourceStatus)
+	}
+	want := "UPDATE_IN_PROGRESS,UPDATE_COMPLETE,UPDATE_IN_PROGRESS,UPDATE_COMPLETE"
+	if strings.Join(got, ",") != want {
+		t.Errorf("events = %v, want %s", got, want)
+	}
+	tail.poll()
+	if len(tail.events) != 4 {
+		t.Errorf("a second poll read %d events again", len(tail.events)-4)
+	}
+	if tail.failure() != nil {
+		t.Errorf("failure = %v", tail.failure())
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	cfm "github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// stackPollInterval is the wait between two checks of a stack that is busy.
+var stackPollInterval = 15 * time.Second
+
+// defaultStackWaitTimeout is how long a busy stack is waited for when no timeout is given.
+const defaultStackWaitTimeout = 30 * time.Minute
+
+// stackStatus returns the status of a stack, or an empty status when the stack does not exist.
+func stackStatus(cfmC cloudformationiface.CloudFormationAPI, stackName string) (string, error) {
+	dso, err := cfmC.DescribeStacks(&cfm.DescribeStacksInput{StackName: aws.String(stackName)})
+	if err != nil {
+		if strings.Contains(err.Error(), "does not exist") {
+			return "", nil
+		}
+		return "", fmt.Errorf("ERROR: Failed to retrieve stack status: %v", err.Error())
+	}
+	return *dso.Stacks[0].StackStatus, nil
+}
+
+// confirmRepair asks before a stack is deleted to repair it. Without a terminal, only AutoApprove allows it.
+func confirmRepair(question string, opts policyOptions) error {
+	if opts.AutoApprove {
+		return nil
+	}
+	if !isInteractive() {
+		return fmt.Errorf("ERROR: %s Refusing without a terminal to approve it, use --auto-approve", question)
+	}
+	if !ask(question) {
+		return fmt.Errorf("ERROR: Repair of the stack was declined")
+	}
+	return nil
+}
+
+// readyPolicyStack brings a policy stack to a state a change set can be created on, and returns
+// the type of the change set: CREATE when there is no stack, or no usable stack, else UPDATE.
+//   - A stack in progress is waited for until it settles, for WaitTimeout at most.
+//   - A stack in REVIEW_IN_PROGRESS was never executed and has no resources, it is created.
+//   - A stack in ROLLBACK_COMPLETE failed to be created and can only be deleted. It is deleted
+//     after a confirmation and created again.
+//   - A stack in UPDATE_ROLLBACK_FAILED has its rollback continued.
+//
+// A dry run does not repair the stack, it fails instead.
+func readyPolicyStack(cfmC cloudformationiface.CloudFormationAPI, name, stackName string, opts policyOptions) (string, error) {
+	timeout := opts.WaitTimeout
+	if timeout <= 0 {
+		timeout = defaultStackWaitTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	continued := false
+	waiting := ""
+	for {
+		status, err := stackStatus(cfmC, stackName)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case status == "" || status == cfm.StackStatusDeleteComplete || status == cfm.StackStatusReviewInProgress:
+			return cfm.ChangeSetTypeCreate, nil
+
+		case status == cfm.StackStatusRollbackComplete:
+			if opts.DryRun {
+				return "", fmt.Errorf("ERROR: Stack is in %s, it is deleted and created again without --dry-run", status)
+			}
+			question := fmt.Sprintf("Stack %s of %s is in %s and cannot be updated. Delete it and create it again?", stackName, name, status)
+			if err := confirmRepair(question, opts); err != nil {
+				return "", err
+			}
+			if err := deletePolicyStack(cfmC, name, stackName, deadline); err != nil {
+				return "", err
+			}
+			return cfm.ChangeSetTypeCreate, nil
+
+		case status == cfm.StackStatusUpdateRollbackFailed:
+			if opts.DryRun {
+				return "", fmt.Errorf("ERROR: Stack is in %s, its rollback is continued without --dry-run", status)
+			}
+			if continued {
+				return "", fmt.Errorf("ERROR: Stack is in %s again after continuing the rollback, skip the failing resources by hand", status)
+			}
+			log.Printf("INFO: %s: continuing the rollback of the stack in %s", name, status)
+			_, err := cfmC.ContinueUpdateRollback(&cfm.ContinueUpdateRollbackInput{StackName: aws.String(stackName)})
+			if err != nil {
+				return "", fmt.Errorf("ERROR: Failed to continue the rollback of the stack: %v", err)
+			}
+			continued = true
+
+		case strings.HasSuffix(status, "_IN_PROGRESS"):
+			if time.Now().After(deadline) {
+				return "", fmt.Errorf("ERROR: Stack is still %s after waiting %v", status, timeout)
+			}
+			if waiting != status {
+				log.Printf("INFO: %s: waiting for the stack in %s", name, status)
+				waiting = status
+			}
+			time.Sleep(stackPollInterval)
+
+		case strings.HasSuffix(status, "_COMPLETE"):
+			return cfm.ChangeSetTypeUpdate, nil
+
+		default:
+			return "", fmt.Errorf("ERROR: Stack is in %s and has to be repaired by hand", status)
+		}
+	}
+}
+
+// deletePolicyStack deletes a stack and waits until it is gone.
+func deletePolicyStack(cfmC cloudformationiface.CloudFormationAPI, name, stackName string, deadline time.Time) error {
+	log.Printf("INFO: %s: deleting the stack %s", name, stackName)
+	_, err := cfmC.DeleteStack(&cfm.DeleteStackInput{StackName: aws.String(stackName)})
+	if err != nil {
+		return fmt.Errorf("ERROR: Failed to delete the stack %s: %v", stackName, err)
+	}
+	for {
+		status, err := stackStatus(cfmC, stackName)
+		if err != nil {
+			return err
+		}
+		switch {
+		case status == "" || status == cfm.StackStatusDeleteComplete:
+			return nil
+		case status == cfm.StackStatusDeleteFailed:
+			return fmt.Errorf("ERROR: Failed to delete the stack %s, it is in %s", stackName, status)
+		case time.Now().After(deadline):
+			return fmt.Errorf("ERROR: Stack %s is still %s", stackName, status)
+		}
+		time.Sleep(stackPollInterval)
+	}
+}
+
+// RepairStacks brings the policy stacks of the accounts, in every of their regions, to a state
+// update-policy can deploy on. A deleted stack is created again by the next update-policy.
+func RepairStacks(cfg Config, acc []string, opts policyOptions) error {
+	org := readOrgYaml()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tREGION\tSTATUS\tDETAIL")
+	var failed []string
+	for _, alias := range acc {
+		var account *Account
+		accounts := org.allAccounts()
+		for i := range accounts {
+			if accounts[i].Alias == alias {
+				account = &accounts[i]
+			}
+		}
+		if account == nil {
+			fmt.Fprintf(w, "%s\t-\t-\t%s\n", alias, "not in organization.yaml")
+			failed = append(failed, alias)
+			continue
+		}
+		stackName := cfg.stackName(alias)
+		for _, region := range accountRegions(org, *account, cfg.Region) {
+			name := alias + "/" + region
+			cfmC := getCfmClient(profile, cfg.accountRoleARN(account.ID), region)
+			detail := ""
+			_, err := readyPolicyStack(cfmC, name, stackName, opts)
+			if err != nil {
+				detail = err.Error()
+				failed = append(failed, name)
+			}
+			status, serr := stackStatus(cfmC, stackName)
+			if serr != nil {
+				status = "unknown"
+			} else if status == "" {
+				status = "absent"
+				if err == nil {
+					detail = "run update-policy to create it"
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", alias, region, status, detail)
+		}
+	}
+	w.Flush()
+	if len(failed) > 0 {
+		return fmt.Errorf("ERROR: Failed to repair the stacks of %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/annemakhil/org-governor/fakeaws"
+	cfm "github.com/aws/aws-sdk-go/service/cloudformation"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadyPolicyStack(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      string
+		next        []string
+		opts        policyOptions
+		interactive bool
+		answers     string
+		want        string
+		wantStatus  string
+		err         string
+	}{
+		{name: "no stack", want: cfm.ChangeSetTypeCreate},
+		{name: "under review", status: cfm.StackStatusReviewInProgress, want: cfm.ChangeSetTypeCreate, wantStatus: cfm.StackStatusReviewInProgress},
+		{name: "created", status: cfm.StackStatusCreateComplete, want: cfm.ChangeSetTypeUpdate, wantStatus: cfm.StackStatusCreateComplete},
+		{name: "rolled back update", status: cfm.StackStatusUpdateRollbackComplete, want: cfm.ChangeSetTypeUpdate, wantStatus: cfm.StackStatusUpdateRollbackComplete},
+		{name: "in progress", status: cfm.StackStatusUpdateInProgress, next: []string{cfm.StackStatusUpdateInProgress, cfm.StackStatusUpdateCompleteCleanupInProgress, cfm.StackStatusUpdateComplete},
+			want: cfm.ChangeSetTypeUpdate, wantStatus: cfm.StackStatusUpdateComplete},
+		{name: "in progress too long", status: cfm.StackStatusUpdateInProgress, opts: policyOptions{WaitTimeout: time.Nanosecond},
+			err: "still UPDATE_IN_PROGRESS", wantStatus: cfm.StackStatusUpdateInProgress},
+		{name: "rollback complete approved", status: cfm.StackStatusRollbackComplete, opts: policyOptions{AutoApprove: true}, want: cfm.ChangeSetTypeCreate},
+		{name: "rollback complete confirmed", status: cfm.StackStatusRollbackComplete, interactive: true, answers: "y\n", want: cfm.ChangeSetTypeCreate},
+		{name: "rollback complete declined", status: cfm.StackStatusRollbackComplete, interactive: true, answers: "n\n", err: "declined", wantStatus: cfm.StackStatusRollbackComplete},
+		{name: "rollback complete without terminal", status: cfm.StackStatusRollbackComplete, err: "use --auto-approve", wantStatus: cfm.StackStatusRollbackComplete},
+		{name: "rollback complete dry run", status: cfm.StackStatusRollbackComplete, opts: policyOptions{AutoApprove: true, DryRun: true}, err: "without --dry-run", wantStatus: cfm.StackStatusRollbackComplete},
+		{name: "update rollback failed", status: cfm.StackStatusUpdateRollbackFailed, want: cfm.ChangeSetTypeUpdate, wantStatus: cfm.StackStatusUpdateRollbackComplete},
+		{name: "delete failed", status: cfm.StackStatusDeleteFailed, err: "repaired by hand", wantStatus: cfm.StackStatusDeleteFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTest(t, Organization{})
+			stdin = strings.NewReader(tt.answers)
+			isInteractive = func() bool { return tt.interactive }
+			c := fakeaws.NewCloudFormation()
+			if tt.status != "" {
+				c.PutStack(fakeaws.Stack{Name: "Dev-Policies", Status: tt.status, NextStatuses: tt.next})
+			}
+
+			got, err := readyPolicyStack(c, "dev/us-west-2", "Dev-Policies", tt.opts)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("err = %v, want %q", err, tt.err)
+				}
+			} else if err != nil || got != tt.want {
+				t.Errorf("readyPolicyStack = %q, %v, want %q", got, err, tt.want)
+			}
+			status := ""
+			if s := c.Stack("Dev-Policies"); s != nil {
+				status = s.Status
+			}
+			if status != tt.wantStatus {
+				t.Errorf("stack status = %q, want %q", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestUpdatePoliciesRecreatesRolledBackStack(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	devID := fake.org.AddAccount(fake.org.RootID(), "dev", "dev@example.com")
+	writeOrgYaml(Organization{Accounts: []Account{iam}, OrganizationalUnits: []OrganizationalUnit{{Name: "Workloads", Accounts: []Account{
+		{ID: devID, Alias: "dev", Email: "dev@example.com", TemplateFile: writeTemplate(t, "Dev-Policies")},
+	}}}})
+	fake.account(devID).PutStack(fakeaws.Stack{Name: "Dev-Policies", Status: cfm.StackStatusRollbackComplete})
+
+	if err := UpdatePolicies(testConfig, []string{"dev"}, policyOptions{}); err == nil {
+		t.Fatal("the rolled back stack was deleted without an approval")
+	}
+	if err := UpdatePolicies(testConfig, []string{"dev"}, policyOptions{AutoApprove: true}); err != nil {
+		t.Fatal(err)
+	}
+	if s := fake.account(devID).Stack("Dev-Policies"); s.Status != cfm.StackStatusCreateComplete {
+		t.Errorf("stack status = %s", s.Status)
+	}
+}
+
+func TestRepairStacks(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	devID := fake.org.AddAccount(fake.org.RootID(), "dev", "dev@example.com")
+	qaID := fake.org.AddAccount(fake.org.RootID(), "qa", "qa@example.com")
+	writeOrgYaml(Organization{OrganizationalUnits: []OrganizationalUnit{{Name: "Workloads", Accounts: []Account{
+		{ID: devID, Alias: "dev", Email: "dev@example.com"},
+		{ID: qaID, Alias: "qa", Email: "qa@example.com"},
+	}}}})
+	fake.account(devID).PutStack(fakeaws.Stack{Name: "Dev-Policies", Status: cfm.StackStatusRollbackComplete})
+	fake.account(qaID).PutStack(fakeaws.Stack{Name: "Qa-Policies", Status: cfm.StackStatusUpdateRollbackFailed})
+
+	if err := RepairStacks(testConfig, []string{"dev", "qa"}, policyOptions{AutoApprove: true}); err != nil {
+		t.Fatal(err)
+	}
+	if s := fake.account(devID).Stack("Dev-Policies"); s != nil {
+		t.Errorf("rolled back stack was not deleted, status %s", s.Status)
+	}
+	if s := fake.account(qaID).Stack("Qa-Policies"); s.Status != cfm.StackStatusUpdateRollbackComplete {
+		t.Errorf("stack status = %s", s.Status)
+	}
+
+	err := RepairStacks(testConfig, []string{"ops"}, policyOptions{})
+	if err == nil || !strings.Contains(err.Error(), "ops") {
+		t.Errorf("err = %v", err)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	cfm "github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/organizations"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// templateHashTag is the stack tag recording the hash of the template a stack was deployed from.
+const templateHashTag = "org-governor:template-sha256"
+
+// maxTemplateBodySize is the size of the largest template CloudFormation accepts inline.
+const maxTemplateBodySize = 51200
+
+// stackTemplate is the template of a policy stack, passed inline as its Body or, when it is too
+// large for that, as the URL of its copy in the template bucket.
+type stackTemplate struct {
+	URL  string
+	Body string
+	Hash string
+	// Parameters are the parameters the template declares.
+	Parameters map[string]bool
+}
+
+// tags returns the stack tags recording the template of a stack.
+func (t stackTemplate) tags() []*cfm.Tag {
+	return []*cfm.Tag{{Key: aws.String(templateHashTag), Value: aws.String(t.Hash)}}
+}
+
+// templateURL returns the TemplateURL of the CloudFormation calls, nil for an inline template.
+func (t stackTemplate) templateURL() *string {
+	if t.URL == "" {
+		return nil
+	}
+	return aws.String(t.URL)
+}
+
+// templateBody returns the TemplateBody of the CloudFormation calls, nil for an uploaded template.
+func (t stackTemplate) templateBody() *string {
+	if t.Body == "" {
+		return nil
+	}
+	return aws.String(t.Body)
+}
+
+// policyTemplate reads the policy template of an account for a region. A template
+// within the inline limit of CloudFormation is passed as its body and needs no template bucket, a
+// larger one is uploaded once share has shared the bucket.
+func policyTemplate(cfg Config, org Organization, a Account, region, stackName string, share *bucketShare) (stackTemplate, error) {
+	content, err := readPolicyTemplate(cfg, org, a, region)
+	if err != nil {
+		return stackTemplate{}, err
+	}
+	if len(content) <= maxTemplateBodySize {
+		return stackTemplate{Body: string(content), Hash: templateHash(content), Parameters: declaredParameters(content)}, nil
+	}
+	if cfg.TemplateBucket == "" {
+		return stackTemplate{}, fmt.Errorf("ERROR: Policy file %s is %d bytes, over the %d bytes CloudFormation accepts inline, set template_bucket in %s to upload it",
+			cfg.templateFile(a), len(content), maxTemplateBodySize, defaultConfigFile)
+	}
+	if err := share.share(cfg); err != nil {
+		return stackTemplate{}, err
+	}
+	t, err := uploadTemplate(cfg, a.Alias, stackName, content)
+	if err != nil {
+		return stackTemplate{}, err
+	}
+	t.Parameters = declaredParameters(content)
+	return t, nil
+}
+
+// templateData is what the policy templates are rendered with.
+type templateData struct {
+	Account Account
+	// OU is the OU directly holding the account, it is empty for the accounts under the root.
+	OU OrganizationalUnit
+	// Tags are the tags of the account, a missing tag is an error unless read with index.
+	Tags   map[string]string
+	Region string
+}
+
+// templateFuncs are the helper functions of the policy templates, like
+// {{ index .Tags "team" | default "platform" | upper }} or {{ .Account.Regions | join "," }}.
+var templateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"title": strings.Title,
+	"join": func(sep string, items []string) string {
+		return strings.Join(items, sep)
+	},
+	"default": func(def, value string) string {
+		if value == "" {
+			return def
+		}
+		return value
+	},
+	"toJSON": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// renderedTemplateSuffix marks the policy templates rendered with text/template. The other templates
+// are deployed as they are, so CloudFormation syntax like {{resolve:ssm:/path}} needs no escaping.
+const renderedTemplateSuffix = ".tmpl"
+
+// readPolicyTemplate reads the policy template of an account. A template named *.tmpl is rendered
+// with text/template, so that a single template serves every account.
+func readPolicyTemplate(cfg Config, org Organization, a Account, region string) ([]byte, error) {
+	file := cfg.templateFile(a)
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Failed to read the policy file %s with: %v", file, err)
+	}
+	if !strings.HasSuffix(file, renderedTemplateSuffix) {
+		return content, nil
+	}
+	data := templateData{Account: a, Tags: a.Tags, Region: region}
+	if ancestors := accountAncestors(org.OrganizationalUnits, a.Alias); len(ancestors) > 0 {
+		data.OU = ancestors[len(ancestors)-1]
+	}
+	if data.Tags == nil {
+		data.Tags = make(map[string]string)
+	}
+	tmpl, err := template.New(file).Funcs(templateFuncs).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Failed to parse the policy file %s with: %v", file, err)
+	}
+	var rendered bytes.Buffer
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return nil, fmt.Errorf("ERROR: Failed to render the policy file %s for %s with: %v", file, a.Alias, err)
+	}
+	return rendered.Bytes(), nil
+}
+
+// templateHash returns the hex SHA-256 of a template.
+func templateHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// uploadTemplate uploads the policy template of an account under a key made of the stack name
+// and the SHA-256 of the template, so the content of a key never changes and concurrent runs do
+// not overwrite each other. A template that is already in the bucket is not uploaded again. With
+// presigned sharing, the returned URL is a presigned URL of the template.
+func uploadTemplate(cfg Config, alias, stackName string, content []byte) (stackTemplate, error) {
+	hash := templateHash(content)
+	key := stackName + "/" + hash
+	t := stackTemplate{URL: cfg.templateURL(key), Hash: hash}
+
+	s3C := getS3Client(profile, orgRole, cfg.Region)
+	_, err := s3C.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(cfg.TemplateBucket), Key: aws.String(key)})
+	if err == nil {
+		log.Printf("INFO: %s: template %s is already uploaded", alias, hash)
+	} else {
+		if aerr, ok := err.(awserr.Error); !ok || (aerr.Code() != "NotFound" && aerr.Code() != s3.ErrCodeNoSuchKey) {
+			return stackTemplate{}, fmt.Errorf("ERROR: Failed to look up the template %s in s3 with: %v", key, err)
+		}
+		_, err = s3C.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(cfg.TemplateBucket),
+			Body:   bytes.NewReader(content),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return stackTemplate{}, fmt.Errorf("ERROR: Failed to upload the template file to s3 for %s with: %v", alias, err)
+		}
+	}
+	if cfg.TemplateSharing == sharingPresigned {
+		req, _ := s3C.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String(cfg.TemplateBucket), Key: aws.String(key)})
+		t.URL, err = req.Presign(presignExpiry)
+		if err != nil {
+			return stackTemplate{}, fmt.Errorf("ERROR: Failed to presign the template URL of %s with: %v", alias, err)
+		}
+	}
+	return t, nil
+}
+
+// Template sharing modes, they decide how CloudFormation in the member accounts reads the templates.
+const (
+	// sharingOrgPolicy lets the accounts of the organization read the bucket through its bucket policy.
+	sharingOrgPolicy = "org-policy"
+	// sharingPresigned passes the templates as presigned URLs, the bucket stays private.
+	sharingPresigned = "presigned"
+)
+
+// presignExpiry is how long a presigned template URL is valid. CloudFormation reads the template
+// when the change set is created, right after the upload: the URL is presigned once the stack is
+// ready, so it never waits for another operation of the stack.
+const presignExpiry = 15 * time.Minute
+
+// templateReadSid is the ID of the bucket policy statement managed by the tool.
+const templateReadSid = "OrgGovernorTemplateRead"
+
+// bucketPolicy is an S3 bucket policy. The statements are kept raw, so that the statements not
+// managed by the tool are written back as they were.
+type bucketPolicy struct {
+	Version   string            `json:"Version"`
+	ID        string            `json:"Id,omitempty"`
+	Statement []json.RawMessage `json:"Statement"`
+}
+
+// policyStatement is the bucket policy statement letting the organization read the templates.
+type policyStatement struct {
+	Sid       string
+	Effect    string
+	Principal string
+	Action    string
+	Resource  string
+	Condition map[string]map[string]string
+}
+
+// checkTemplateSharing fails on an unknown template sharing mode.
+func checkTemplateSharing(cfg Config) error {
+	switch cfg.TemplateSharing {
+	case sharingOrgPolicy, sharingPresigned:
+		return nil
+	}
+	return fmt.Errorf("ERROR: Unknown template sharing %s, use %s or %s", cfg.TemplateSharing, sharingOrgPolicy, sharingPresigned)
+}
+
+// bucketShare shares the template bucket the first time a run uploads a template, so a run
+// passing every template inline leaves the bucket alone. A nil bucketShare shares nothing, a
+// dry run does not change the bucket policy.
+type bucketShare struct {
+	once sync.Once
+	err  error
+}
+
+func (b *bucketShare) share(cfg Config) error {
+	if b == nil {
+		return nil
+	}
+	b.once.Do(func() {
+		b.err = shareTemplateBucket(cfg)
+	})
+	return b.err
+}
+
+// shareTemplateBucket prepares the template bucket for the sharing mode of the configuration,
+// there is nothing to prepare without a bucket.
+// With org-policy, the bucket policy gets a statement allowing the principals of the organization
+// to read the templates, the other statements of the policy are kept.
+func shareTemplateBucket(cfg Config) error {
+	if err := checkTemplateSharing(cfg); err != nil {
+		return err
+	}
+	if cfg.TemplateSharing == sharingPresigned || cfg.TemplateBucket == "" {
+		return nil
+	}
+	orgC := makeOrgClient(profile, orgRole)
+	org, err := orgC.DescribeOrganization(&organizations.DescribeOrganizationInput{})
+	if err != nil {
+		return fmt.Errorf("ERROR: Failed to describe the organization with: %v", err)
+	}
+	want := policyStatement{
+		Sid:       templateReadSid,
+		Effect:    "Allow",
+		Principal: "*",
+		Action:    "s3:GetObject",
+		Resource:  fmt.Sprintf("arn:aws:s3:::%s/*", cfg.TemplateBucket),
+		Condition: map[string]map[string]string{"StringEquals": {"aws:PrincipalOrgID": *org.Organization.Id}},
+	}
+
+	s3C := getS3Client(profile, orgRole, cfg.Region)
+	policy := bucketPolicy{Version: "2012-10-17"}
+	out, err := s3C.GetBucketPolicy(&s3.GetBucketPolicyInput{Bucket: aws.String(cfg.TemplateBucket)})
+	if err == nil {
+		if err := json.Unmarshal([]byte(aws.StringValue(out.Policy)), &policy); err != nil {
+			return fmt.Errorf("ERROR: Failed to parse the policy of the bucket %s: %v", cfg.TemplateBucket, err)
+		}
+	} else if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "NoSuchBucketPolicy" {
+		return fmt.Errorf("ERROR: Failed to read the policy of the bucket %s with: %v", cfg.TemplateBucket, err)
+	}
+
+	var statements []json.RawMessage
+	for _, raw := range policy.Statement {
+		var st policyStatement
+		if json.Unmarshal(raw, &st) == nil && reflect.DeepEqual(st, want) {
+			return nil
+		}
+		var id struct{ Sid string }
+		if json.Unmarshal(raw, &id) == nil && id.Sid == templateReadSid {
+			continue
+		}
+		statements = append(statements, raw)
+	}
+	raw, err := json.Marshal(want)
+	if err != nil {
+		return err
+	}
+	policy.Statement = append(statements, raw)
+	content, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	log.Printf("INFO: Granting organization %s read access to the templates in %s", *org.Organization.Id, cfg.TemplateBucket)
+	_, err = s3C.PutBucketPolicy(&s3.PutBucketPolicyInput{Bucket: aws.String(cfg.TemplateBucket), Policy: aws.String(string(content))})
+	if err != nil {
+		return fmt.Errorf("ERROR: Failed to update the policy of the bucket %s with: %v", cfg.TemplateBucket, err)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/annemakhil/org-governor/fakeaws"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUploadTemplate(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	content := []byte(testTemplate)
+
+	first, err := uploadTemplate(testConfig, "dev", "Dev-Policies", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(first.URL, "/Dev-Policies/"+first.Hash) || len(first.Hash) != 64 {
+		t.Errorf("template = %+v", first)
+	}
+	again, err := uploadTemplate(testConfig, "dev", "Dev-Policies", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, first) || fake.s3.Uploads() != 1 {
+		t.Errorf("second upload = %+v after %d uploads, want %+v and a single upload", again, fake.s3.Uploads(), first)
+	}
+
+	changed, err := uploadTemplate(testConfig, "dev", "Dev-Policies", []byte(testTemplate+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.Hash == first.Hash || fake.s3.Uploads() != 2 {
+		t.Errorf("changed template = %+v after %d uploads", changed, fake.s3.Uploads())
+	}
+	// The previous version stays in the bucket for the stacks deployed from it.
+	if _, ok := fake.s3.Object(testConfig.TemplateBucket, "Dev-Policies/"+first.Hash); !ok {
+		t.Error("the previous template was overwritten")
+	}
+}
+
+func TestPolicyTemplate(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	small := Account{Alias: "dev", TemplateFile: writeTemplate(t, "Dev-Policies")}
+	large := Account{Alias: "qa", TemplateFile: writeLargeTemplate(t, "Qa-Policies")}
+
+	template, err := policyTemplate(testConfig, Organization{}, small, defaultRegion, "Dev-Policies", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.Body != testTemplate || template.templateURL() != nil {
+		t.Errorf("small template = %+v", template)
+	}
+	template, err = policyTemplate(testConfig, Organization{}, large, defaultRegion, "Qa-Policies", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.templateBody() != nil || !strings.HasSuffix(template.URL, "/Qa-Policies/"+template.Hash) || fake.s3.Uploads() != 1 {
+		t.Errorf("large template = %+v after %d uploads", template, fake.s3.Uploads())
+	}
+
+	cfg := testConfig
+	cfg.TemplateBucket = ""
+	if _, err := policyTemplate(cfg, Organization{}, large, defaultRegion, "Qa-Policies", nil); err == nil || !strings.Contains(err.Error(), "set template_bucket") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestUploadTemplatePresigned(t *testing.T) {
+	setupTest(t, Organization{})
+	cfg := testConfig
+	cfg.TemplateSharing = sharingPresigned
+
+	template, err := uploadTemplate(cfg, "dev", "Dev-Policies", []byte(testTemplate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(template.URL, "/Dev-Policies/"+template.Hash+"?") || !strings.Contains(template.URL, "X-Amz-Signature=") {
+		t.Errorf("template URL = %s", template.URL)
+	}
+}
+
+func TestShareTemplateBucket(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	other := `{"Sid":"Audit","Effect":"Allow","Principal":{"AWS":"arn:aws:iam::111111111111:root"},"Action":"s3:ListBucket","Resource":"arn:aws:s3:::templates"}`
+	stale := `{"Sid":"OrgGovernorTemplateRead","Effect":"Allow","Principal":"*","Action":"s3:GetObject","Resource":"arn:aws:s3:::templates/*","Condition":{"StringEquals":{"aws:PrincipalOrgID":"o-old"}}}`
+	if _, err := fake.s3.PutBucketPolicy(&s3.PutBucketPolicyInput{
+		Bucket: aws.String("templates"),
+		Policy: aws.String(`{"Version":"2012-10-17","Statement":[` + other + `,` + stale + `]}`),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := shareTemplateBucket(testConfig); err != nil {
+		t.Fatal(err)
+	}
+	var policy bucketPolicy
+	if err := json.Unmarshal([]byte(fake.s3.Policy("templates")), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Statement) != 2 || string(policy.Statement[0]) != other {
+		t.Fatalf("statements = %s", policy.Statement)
+	}
+	if !strings.Contains(string(policy.Statement[1]), fakeaws.OrganizationID) {
+		t.Errorf("statement = %s", policy.Statement[1])
+	}
+
+	// An up to date policy is not written again, and presigned sharing leaves it alone.
+	updates := fake.s3.PolicyUpdates()
+	if err := shareTemplateBucket(testConfig); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig
+	cfg.TemplateSharing = sharingPresigned
+	if err := shareTemplateBucket(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if fake.s3.PolicyUpdates() != updates {
+		t.Errorf("the bucket policy was written %d more times", fake.s3.PolicyUpdates()-updates)
+	}
+
+	cfg.TemplateSharing = "acl"
+	if err := shareTemplateBucket(cfg); err == nil || !strings.Contains(err.Error(), "Unknown template sharing") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestReadPolicyTemplate(t *testing.T) {
+	setupTest(t, Organization{})
+	cfg := testConfig
+	cfg.DefaultTemplate = defaultTemplate + renderedTemplateSuffix
+	master := `{"Team": "{{ index .Tags "team" | default "platform" | upper }}", "Account": "{{ .Account.Alias }}/{{ .Account.ID }}",` +
+		` "OU": "{{ .OU.Name }}", "Region": "{{ .Region }}", "Regions": {{ toJSON .Account.Regions }}}`
+	if err := ioutil.WriteFile(cfg.DefaultTemplate, []byte(master), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dev := Account{ID: "100000000001", Alias: "dev", Regions: []string{"eu-west-1"}, Tags: map[string]string{"team": "data"}}
+	ops := Account{ID: "100000000002", Alias: "ops"}
+	org := Organization{Accounts: []Account{ops}, OrganizationalUnits: []OrganizationalUnit{{Name: "Workloads", OrganizationalUnits: []OrganizationalUnit{
+		{Name: "Dev", Accounts: []Account{dev}},
+	}}}}
+
+	tests := []struct {
+		account Account
+		want    string
+	}{
+		{dev, `{"Team": "DATA", "Account": "dev/100000000001", "OU": "Dev", "Region": "eu-west-1", "Regions": ["eu-west-1"]}`},
+		{ops, `{"Team": "PLATFORM", "Account": "ops/100000000002", "OU": "", "Region": "eu-west-1", "Regions": null}`},
+	}
+	for _, tt := range tests {
+		got, err := readPolicyTemplate(cfg, org, tt.account, "eu-west-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s template = %s, want %s", tt.account.Alias, got, tt.want)
+		}
+	}
+
+	if err := ioutil.WriteFile(cfg.DefaultTemplate, []byte(`{"Team": "{{ .Tags.team }}"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPolicyTemplate(cfg, org, ops, "eu-west-1"); err == nil || !strings.Contains(err.Error(), "render") {
+		t.Errorf("a missing tag was rendered, err = %v", err)
+	}
+
+	// A template without the suffix is not rendered, its dynamic references reach CloudFormation.
+	plain := `{"Team": "{{resolve:ssm:/org/team}}"}`
+	if err := ioutil.WriteFile(defaultTemplate, []byte(plain), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readPolicyTemplate(testConfig, org, ops, "eu-west-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != plain {
+		t.Errorf("plain template = %s, want %s", got, plain)
+	}
+}
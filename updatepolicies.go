@@ -1,213 +1,708 @@
 package main
 
 import (
-	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	cfm "github.com/aws/aws-sdk-go/service/cloudformation"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/cloudformation/cloudformationiface"
 	"github.com/google/uuid"
-	"io/ioutil"
+	"io"
 	"log"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
 )
 
+// Outcomes of the policy update of an account.
 const (
-	templateBucket = "<yet to be decided>"
+	outcomeCreated  = "created"
+	outcomeUpdated  = "updated"
+	outcomeNoChange = "no-change"
+	outcomeFailed   = "failed"
+	outcomeSkipped  = "skipped"
+	outcomeRejected = "rejected"
+
+	outcomeWouldCreate = "would-create"
+	outcomeWouldUpdate = "would-update"
+)
+
+// previewOutcomes are the outcomes a dry run reports instead of the outcome of executing the change set.
+var previewOutcomes = map[string]string{
+	outcomeCreated:  outcomeWouldCreate,
+	outcomeUpdated:  outcomeWouldUpdate,
+	outcomeNoChange: outcomeNoChange,
+}
+
+// Formats of the dry run output.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
 )
 
-func UpdatePolicies(acc []string, gu bool) error {
+// policyOptions are the settings of an update-policy run.
+type policyOptions struct {
+	// UpdateIAM adds the exported outputs of the account stacks to the groups of the identity account.
+	UpdateIAM bool
+	// Parallelism is the number of stacks deployed at the same time, across accounts and regions.
+	Parallelism int
+	// FailFast skips the stacks that have not started yet once a stack fails.
+	FailFast bool
+	// Parameters are stack parameters given on the command line, they override every other value.
+	Parameters map[string]string
+	// DryRun prints the changes of the change sets and deletes them without executing them.
+	DryRun bool
+	// Output is the format of the dry run changes, table or json.
+	Output string
+	// AutoApprove executes the change sets without asking for an approval.
+	AutoApprove bool
+	// Approval asks for the approval of the whole batch at once, or of every account on its own.
+	Approval string
+	// AllowReplacement lets change sets replace or remove IAM roles, policies and groups.
+	AllowReplacement bool
+	// WaitTimeout is how long a stack busy with another operation is waited for.
+	WaitTimeout time.Duration
+}
+
+// policyResult is the outcome of deploying the policy stack of one account in one region.
+type policyResult struct {
+	Alias   string
+	Region  string
+	Outcome string
+	Outputs map[string][]string
+	Changes []policyChange
+	Err     error
+}
+
+// name identifies the deployment in logs and errors, the region is left out when it is unknown.
+func (r policyResult) name() string {
+	if r.Region == "" {
+		return r.Alias
+	}
+	return r.Alias + "/" + r.Region
+}
+
+// printPolicySummary prints the outcome of every account and region as a table.
+func printPolicySummary(out io.Writer, results []policyResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tREGION\tOUTCOME\tDETAIL")
+	for _, r := range results {
+		region, detail := r.Region, ""
+		if region == "" {
+			region = "-"
+		}
+		if r.Err != nil {
+			detail = r.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Alias, region, r.Outcome, detail)
+	}
+	w.Flush()
+}
+
+// printPolicyChanges prints the resource changes of every account and region as a table.
+func printPolicyChanges(out io.Writer, results []policyResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tREGION\tACTION\tLOGICAL ID\tTYPE\tREPLACEMENT\tSCOPE")
+	for _, r := range results {
+		for _, c := range r.Changes {
+			replacement := c.Replacement
+			if replacement == "" {
+				replacement = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", r.Alias, r.Region, c.Action, c.LogicalID, c.ResourceType, replacement, strings.Join(c.Scope, ","))
+		}
+	}
+	w.Flush()
+}
+
+// policyPreview is the JSON form of the dry run of one account and region.
+type policyPreview struct {
+	Account string         `json:"account"`
+	Region  string         `json:"region,omitempty"`
+	Outcome string         `json:"outcome"`
+	Error   string         `json:"error,omitempty"`
+	Changes []policyChange `json:"changes"`
+}
+
+// printPolicyChangesJSON prints the outcome and resource changes of every account and region as JSON.
+func printPolicyChangesJSON(out io.Writer, results []policyResult) error {
+	previews := make([]policyPreview, 0, len(results))
+	for _, r := range results {
+		p := policyPreview{Account: r.Alias, Region: r.Region, Outcome: r.Outcome, Changes: r.Changes}
+		if p.Changes == nil {
+			p.Changes = []policyChange{}
+		}
+		if r.Err != nil {
+			p.Error = r.Err.Error()
+		}
+		previews = append(previews, p)
+	}
+	b, err := json.MarshalIndent(previews, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ERROR: Failed to marshal the changes: %v", err)
+	}
+	_, err = fmt.Fprintln(out, string(b))
+	return err
+}
+
+// homeRegionParameter is the stack parameter receiving the home region, it is passed to the templates
+// declaring it. A template deployed to several regions creates its IAM resources under a condition
+// like {"Fn::Equals": [{"Ref": "AWS::Region"}, {"Ref": "HomeRegion"}]}, so they only exist once.
+const homeRegionParameter = "HomeRegion"
+
+// withHomeRegion adds the home region to the stack parameters, unless organization.yaml or the
+// command line already set it.
+func withHomeRegion(params []*cfm.Parameter, home string) []*cfm.Parameter {
+	for _, p := range params {
+		if *p.ParameterKey == homeRegionParameter {
+			return params
+		}
+	}
+	return append(params, &cfm.Parameter{ParameterKey: aws.String(homeRegionParameter), ParameterValue: aws.String(home)})
+}
+
+// withPreviousValues keeps the values of the parameters a stack already has that the template still
+// declares and params does not set, like the members of an iam group without outputs in this run.
+// CloudFormation would reset them to their default otherwise.
+func withPreviousValues(params, previous []*cfm.Parameter, declared map[string]bool) []*cfm.Parameter {
+	set := make(map[string]bool)
+	for _, p := range params {
+		set[*p.ParameterKey] = true
+	}
+	for _, p := range previous {
+		key := aws.StringValue(p.ParameterKey)
+		if !set[key] && declared[key] {
+			params = append(params, &cfm.Parameter{ParameterKey: aws.String(key), UsePreviousValue: aws.Bool(true)})
+		}
+	}
+	return params
+}
+
+// accountRegions returns the regions the policy stack of an account is deployed to: the
+// regions of the account, or else of its closest OU declaring some. The home region always
+// comes first, it holds the stack whose outputs feed the iam groups.
+func accountRegions(org Organization, a Account, home string) []string {
+	regions := a.Regions
+	if len(regions) == 0 {
+		ancestors := accountAncestors(org.OrganizationalUnits, a.Alias)
+		for i := len(ancestors) - 1; i >= 0 && len(regions) == 0; i-- {
+			regions = ancestors[i].Regions
+		}
+	}
+	return uniq(append([]string{home}, regions...))
+}
+
+func UpdatePolicies(cfg Config, acc []string, opts policyOptions) error {
+	if opts.Output != "" && opts.Output != outputTable && opts.Output != outputJSON {
+		return fmt.Errorf("ERROR: Unknown output format %s, use %s or %s", opts.Output, outputTable, outputJSON)
+	}
+	if err := checkTemplateSharing(cfg); err != nil {
+		return err
+	}
+	var share *bucketShare
+	if !opts.DryRun {
+		share = &bucketShare{}
+	}
 	var org Organization
 	org = readOrgYaml()
-	var IamAccId, ProdAccId string
-	for _, ou := range org.OrganizationalUnits {
-		for _, acc := range ou.Accounts {
-			if acc.Alias == "aqfer-iam" {
-				IamAccId = acc.ID
-			} else if acc.Alias == "aqfer-prod" {
-				ProdAccId = acc.ID
+	roles, err := org.roleAccounts()
+	if err != nil {
+		return err
+	}
+	roleParams := make(map[string]string)
+	for role, param := range roleParameters {
+		roleParams[param] = roles[role].ID
+	}
+	// A deployment is the policy stack of one account in one of its regions.
+	type deployment struct {
+		account Account
+		region  string
+	}
+	var deployments []deployment
+	var results []policyResult
+	for _, l := range acc {
+		found := false
+		for _, a := range org.allAccounts() {
+			if l == a.Alias {
+				for _, region := range accountRegions(org, a, cfg.Region) {
+					deployments = append(deployments, deployment{account: a, region: region})
+				}
+				found = true
 			}
 		}
+		if !found {
+			// An account asked for by name that is unknown fails the run, it would get no stack.
+			results = append(results, policyResult{Alias: l, Outcome: outcomeFailed, Err: fmt.Errorf("not in organization.yaml")})
+		}
+	}
+
+	if opts.Approval != "" && opts.Approval != approvalBatch && opts.Approval != approvalAccount {
+		return fmt.Errorf("ERROR: Unknown approval mode %s, use %s or %s", opts.Approval, approvalBatch, approvalAccount)
 	}
+	parallelism := opts.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	// The change sets of every stack are created first and approved, only then they are executed.
+	deployed := make([]policyResult, len(deployments))
+	changeSets := make([]*policyChangeSet, len(deployments))
+	skip := func(i int) {
+		deployed[i].Outcome, deployed[i].Err = outcomeSkipped, fmt.Errorf("an earlier stack failed")
+		if changeSets[i] != nil {
+			if err := changeSets[i].discard(); err != nil {
+				deployed[i].Outcome, deployed[i].Err = outcomeFailed, err
+			}
+			changeSets[i] = nil
+		}
+	}
+	runParallel(len(deployments), parallelism, opts.FailFast, func(i int) error {
+		a, region := deployments[i].account, deployments[i].region
+		deployed[i] = policyResult{Alias: a.Alias, Region: region, Outcome: outcomeFailed}
+		log.Printf("Updating Policy template for %s in %s.\n", a.Alias, region)
+		params := stackParameters(org, a, roleParams, opts.Parameters)
+		cs, err := preparePolicyChangeSet(cfg, org, a, region, params, share, opts)
+		if err != nil {
+			deployed[i].Err = err
+			return err
+		}
+		deployed[i].Changes = cs.changes
+		if blocked := blockedChanges(cfg, a.Alias, cs.changes); len(blocked) > 0 && !opts.AllowReplacement {
+			var report []string
+			for _, c := range blocked {
+				report = append(report, fmt.Sprintf("%s %s (%s)", c.Action, c.LogicalID, c.ResourceType))
+			}
+			deployed[i].Err = fmt.Errorf("IAM resources would be replaced or removed: %s, use --allow-replacement or allow_replacement in %s", strings.Join(report, ", "), defaultConfigFile)
+			if opts.DryRun {
+				// The preview shows the blocked changes flagged, the change set is discarded with the others.
+				log.Printf("INFO: %s: %v", deployed[i].name(), deployed[i].Err)
+				changeSets[i] = cs
+				deployed[i].Outcome = previewOutcomes[cs.outcome]
+				return nil
+			}
+			for _, c := range blocked {
+				log.Printf("ERROR: %s: %s of %s %s is blocked, replacement: %s", deployed[i].name(), c.Action, c.ResourceType, c.LogicalID, c.Replacement)
+			}
+			if err := cs.discard(); err != nil {
+				log.Printf("ERROR: %s: %v", deployed[i].name(), err)
+			}
+			return deployed[i].Err
+		}
+		changeSets[i] = cs
+		deployed[i].Outcome = previewOutcomes[cs.outcome]
+		return nil
+	}, func(i int) {
+		deployed[i] = policyResult{Alias: deployments[i].account.Alias, Region: deployments[i].region}
+		skip(i)
+	})
+
+	stopped := false
+	for _, r := range deployed {
+		stopped = stopped || (opts.FailFast && r.Outcome == outcomeFailed)
+	}
+	switch {
+	case opts.DryRun:
+		for i, cs := range changeSets {
+			if cs != nil {
+				if err := cs.discard(); err != nil {
+					deployed[i].Outcome, deployed[i].Err = outcomeFailed, err
+				}
+			}
+		}
+	case stopped:
+		for i := range changeSets {
+			if changeSets[i] != nil {
+				skip(i)
+			}
+		}
+	default:
+		if err := approveChangeSets(deployed, changeSets, opts); err != nil {
+			for _, cs := range changeSets {
+				if cs != nil {
+					_ = cs.discard()
+				}
+			}
+			return err
+		}
+		runParallel(len(deployments), parallelism, opts.FailFast, func(i int) error {
+			cs := changeSets[i]
+			if cs == nil {
+				return nil
+			}
+			outputs, err := cs.execute()
+			if err != nil {
+				deployed[i].Outcome, deployed[i].Err = outcomeFailed, err
+				return err
+			}
+			deployed[i].Outcome = cs.outcome
+			if deployments[i].region == cfg.Region {
+				// Only the home region stack holds the global resources exported to the iam groups.
+				deployed[i].Outputs = outputs
+			}
+			return nil
+		}, skip)
+	}
+
+	// Results are merged once every worker is done, in the order the accounts were given.
 	iamInput := make(map[string][]string)
-	for _, l := range acc {
-		for _, ou := range org.OrganizationalUnits {
-			for _, a := range ou.Accounts {
-				if l == a.Alias {
-					log.Printf("Updating Policy template for %s.\n", a.Alias)
-					orgAccAccessRole := fmt.Sprintf("arn:aws:iam::%s:role/OrganizationAccountAccessRole", a.ID)
-					rand, _ := uuid.NewRandom()
-					changeSetName := aws.String(fmt.Sprintf("cs-%s", rand.String()))
-					// templateBucket := "akhil-org-test"
-					templateKey := strings.Title(a.Alias) + "-Policies"
-					s3C := getS3Client(profile, orgRole)
-					content, err := ioutil.ReadFile(a.TemplateFile)
-					if err != nil {
-						return fmt.Errorf("ERROR: Failed to read the policy file %s with: %v", a.TemplateFile, err)
-					}
-					_, err = s3C.PutObject(&s3.PutObjectInput{
-						Bucket: aws.String(templateBucket),
-						Body:   bytes.NewReader(content),
-						Key:    aws.String(templateKey),
-					})
-					if err != nil {
-						return fmt.Errorf("ERROR: Failed to upload the template file to s3 for %s with: %v", a.Alias, err)
-					}
-					grantee := "emailAddress=" + a.Email
-					_, err = s3C.PutObjectAcl(&s3.PutObjectAclInput{
-						Bucket:    aws.String(templateBucket),
-						Key:       aws.String(templateKey),
-						GrantRead: aws.String(grantee),
-					})
-					if err != nil {
-						return fmt.Errorf("ERROR: Failed to apply ACL to the uploaded template file with: %v", err)
-					}
-					s3URL := fmt.Sprintf("https://%s.s3-%s.amazonaws.com/%s", templateBucket, defaultRegion, templateKey)
-					cfmC := getCfmClient(profile, orgAccAccessRole)
-					dso, err := cfmC.DescribeStacks(&cfm.DescribeStacksInput{StackName: aws.String(strings.Title(a.Alias) + "-Policies")})
-					createInput := cfm.CreateChangeSetInput{
-						ChangeSetName: changeSetName,
-						StackName:     aws.String(strings.Title(a.Alias) + "-Policies"),
-						TemplateURL:   aws.String(s3URL),
-						Capabilities:  aws.StringSlice([]string{"CAPABILITY_NAMED_IAM"}),
-					}
-					if err != nil {
-						if strings.Contains(err.Error(), "does not exist") {
-							createInput.SetChangeSetType("CREATE")
-							createInput.SetParameters([]*cfm.Parameter{
-								&cfm.Parameter{ParameterKey: aws.String("IamAccountID"), ParameterValue: aws.String(IamAccId)},
-								&cfm.Parameter{ParameterKey: aws.String("ProdccountID"), ParameterValue: aws.String(ProdAccId)},
-							})
-						} else {
-							return fmt.Errorf("ERROR: Failed to retrieve stack status: %v", err.Error())
-						}
-					} else {
-						status := *dso.Stacks[0].StackStatus
-						if strings.Contains(status, "COMPLETE") && !strings.Contains(status, "PROGRESS") {
-							createInput.SetChangeSetType("UPDATE")
-							createInput.SetParameters([]*cfm.Parameter{
-								&cfm.Parameter{ParameterKey: aws.String("IamAccountID"), ParameterValue: aws.String(IamAccId)},
-								&cfm.Parameter{ParameterKey: aws.String("ProdccountID"), ParameterValue: aws.String(ProdAccId)},
-							})
-						} else {
-							return fmt.Errorf("ERROR: Stack is busy with status: %s", status)
-						}
-					}
-					result, err := cfmC.CreateChangeSet(&createInput)
-					if err != nil {
-						return fmt.Errorf("ERROR: Failed to create change set: %v", err.Error())
-					}
-					log.Println("INFO: waiting for change set creation to complete...")
-					err = cfmC.WaitUntilChangeSetCreateComplete(&cfm.DescribeChangeSetInput{ChangeSetName: result.Id})
-					dcso, derr := cfmC.DescribeChangeSet(&cfm.DescribeChangeSetInput{ChangeSetName: result.Id})
-					if derr != nil {
-						return fmt.Errorf("ERROR: Failed to describe change set: %v", err.Error())
-					}
-					if err != nil {
-						reason := *dcso.StatusReason
-						if *dcso.Status == "FAILED" {
-							if strings.Contains(reason, "No updates") ||
-								strings.Contains(reason, "didn't contain changes") {
-								log.Println("INFO: No changes detected")
-								return nil
-							}
-							return fmt.Errorf("change set creation failed: %s", reason)
-						}
-					}
-					log.Println("INFO: executing change set")
-					_, err = cfmC.ExecuteChangeSet(&cfm.ExecuteChangeSetInput{ChangeSetName: result.Id})
-					if err != nil {
-						return fmt.Errorf("ERROR: Failed to execute change set: %v", err.Error())
-					}
-					if *createInput.ChangeSetType == "CREATE" {
-						err = cfmC.WaitUntilStackCreateComplete(&cfm.DescribeStacksInput{StackName: aws.String(strings.Title(a.Alias) + "-Policies")})
-						if err != nil {
-							return fmt.Errorf("ERROR: Failed to create stack: %v", err.Error())
-						}
-						log.Println("INFO: Stack is created successfully")
-					} else {
-						err = cfmC.WaitUntilStackUpdateComplete(&cfm.DescribeStacksInput{StackName: aws.String(strings.Title(a.Alias) + "-Policies")})
-						if err != nil {
-							return fmt.Errorf("ERROR: Failed to update stack: %v", err.Error())
-						}
-						log.Println("INFO: Stack is updated successfully")
-					}
-					dso, err = cfmC.DescribeStacks(&cfm.DescribeStacksInput{StackName: aws.String(strings.Title(a.Alias) + "-Policies")})
-					for _, so := range dso.Stacks[0].Outputs {
-						iamInput[*so.ExportName] = append(iamInput[*so.ExportName], *so.OutputValue)
-					}
+	for _, r := range deployed {
+		for k, v := range r.Outputs {
+			iamInput[k] = append(iamInput[k], v...)
+		}
+	}
+	results = append(results, deployed...)
+	var failed []string
+	for _, r := range results {
+		if r.Outcome == outcomeFailed {
+			failed = append(failed, r.name())
+		}
+	}
+	if opts.DryRun && opts.Output == outputJSON {
+		if err := printPolicyChangesJSON(os.Stdout, results); err != nil {
+			return err
+		}
+	} else {
+		if opts.DryRun {
+			printPolicyChanges(os.Stdout, results)
+			fmt.Println()
+		}
+		printPolicySummary(os.Stdout, results)
+	}
+	if opts.DryRun && opts.UpdateIAM {
+		log.Println("INFO: Dry run, the iam groups are not updated")
+	}
+	if opts.UpdateIAM && !opts.DryRun && (len(failed) == 0 || !opts.FailFast) {
+		if err := AddToGroups(cfg, iamInput, opts.Parameters); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("ERROR: Failed to update the policies of %d stack(s): %s", len(failed), strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// stackParameters merges the stack parameters of an account. Later sources take precedence:
+// the built-in defaults, the organization, the OUs from the top of the tree down to the
+// account's OU, the account and finally the command line.
+func stackParameters(org Organization, a Account, defaults, cliParams map[string]string) []*cfm.Parameter {
+	merged := make(map[string]string)
+	sources := []map[string]string{defaults, org.Parameters}
+	for _, ou := range accountAncestors(org.OrganizationalUnits, a.Alias) {
+		sources = append(sources, ou.Parameters)
+	}
+	sources = append(sources, a.Parameters, cliParams)
+	for _, src := range sources {
+		for k, v := range src {
+			merged[k] = v
+		}
+	}
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	params := make([]*cfm.Parameter, 0, len(keys))
+	for _, k := range keys {
+		params = append(params, &cfm.Parameter{ParameterKey: aws.String(k), ParameterValue: aws.String(merged[k])})
+	}
+	return params
+}
+
+// parseParameters parses Key=Value pairs. The comma splitting of slice flags is undone by
+// joining an item without '=' to the value of the previous pair.
+func parseParameters(pairs []string) (map[string]string, error) {
+	params := make(map[string]string)
+	last := ""
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) == 2 && kv[0] != "" {
+			params[kv[0]] = kv[1]
+			last = kv[0]
+			continue
+		}
+		if last == "" {
+			return nil, fmt.Errorf("ERROR: Parameter %q is not in the Key=Value format", p)
+		}
+		params[last] += "," + p
+	}
+	return params, nil
+}
+
+// runParallel calls fn for the indexes from 0 to n-1, at most parallelism at the same time. With
+// failFast set, once fn returns an error the indexes that have not started yet go to skip instead.
+func runParallel(n, parallelism int, failFast bool, fn func(i int) error, skip func(i int)) {
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	var stop int32
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if atomic.LoadInt32(&stop) != 0 {
+					skip(i)
+					continue
+				}
+				if err := fn(i); err != nil && failFast {
+					atomic.StoreInt32(&stop, 1)
 				}
 			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// policyChange is a resource change of a policy change set.
+type policyChange struct {
+	Action       string   `json:"action"`
+	LogicalID    string   `json:"logical_id"`
+	ResourceType string   `json:"resource_type"`
+	Replacement  string   `json:"replacement,omitempty"`
+	Scope        []string `json:"scope,omitempty"`
+}
+
+// policyChangeSet is a created change set of a policy stack, ready to be executed or discarded.
+type policyChangeSet struct {
+	cfmC cloudformationiface.CloudFormationAPI
+	// name identifies the account and region in the logs.
+	name      string
+	stackName string
+	id        *string
+	// outcome is created or updated, or no-change when the change set has nothing to execute.
+	outcome string
+	changes []policyChange
+}
+
+// preparePolicyChangeSet uploads the policy template of an account and creates the change set
+// of its policy stack in a region.
+func preparePolicyChangeSet(cfg Config, org Organization, a Account, region string, params []*cfm.Parameter, share *bucketShare, opts policyOptions) (*policyChangeSet, error) {
+	orgAccAccessRole := cfg.accountRoleARN(a.ID)
+	rand, _ := uuid.NewRandom()
+	changeSetName := aws.String(fmt.Sprintf("cs-%s", rand.String()))
+	stackName := cfg.stackName(a.Alias)
+	name := a.Alias + "/" + region
+	cfmC := getCfmClient(profile, orgAccAccessRole, region)
+	changeSetType, err := readyPolicyStack(cfmC, name, stackName, opts)
+	if err != nil {
+		return nil, err
+	}
+	// The template is uploaded once the stack is ready, a presigned URL must not expire while
+	// the stack is waited for.
+	template, err := policyTemplate(cfg, org, a, region, stackName, share)
+	if err != nil {
+		return nil, err
+	}
+	if template.Parameters[homeRegionParameter] {
+		params = withHomeRegion(params, cfg.Region)
+	}
+	if changeSetType == cfm.ChangeSetTypeUpdate {
+		dso, err := cfmC.DescribeStacks(&cfm.DescribeStacksInput{StackName: aws.String(stackName)})
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: Failed to describe stack: %v", err.Error())
 		}
+		params = withPreviousValues(params, dso.Stacks[0].Parameters, template.Parameters)
 	}
-	if gu {
-		AddToGroups(iamInput)
+	createInput := cfm.CreateChangeSetInput{
+		ChangeSetName: changeSetName,
+		ChangeSetType: aws.String(changeSetType),
+		StackName:     aws.String(stackName),
+		TemplateURL:   template.templateURL(),
+		TemplateBody:  template.templateBody(),
+		Capabilities:  aws.StringSlice([]string{"CAPABILITY_NAMED_IAM"}),
+		Parameters:    params,
+		Tags:          template.tags(),
 	}
+	result, err := cfmC.CreateChangeSet(&createInput)
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Failed to create change set: %v", err.Error())
+	}
+	log.Printf("INFO: %s: waiting for change set creation to complete...", name)
+	err = cfmC.WaitUntilChangeSetCreateComplete(&cfm.DescribeChangeSetInput{ChangeSetName: result.Id})
+	dcso, derr := cfmC.DescribeChangeSet(&cfm.DescribeChangeSetInput{ChangeSetName: result.Id})
+	if derr != nil {
+		return nil, fmt.Errorf("ERROR: Failed to describe change set: %v", derr.Error())
+	}
+	cs := &policyChangeSet{cfmC: cfmC, name: name, stackName: stackName, id: result.Id, outcome: outcomeUpdated}
+	if *createInput.ChangeSetType == "CREATE" {
+		cs.outcome = outcomeCreated
+	}
+	if err != nil {
+		reason := *dcso.StatusReason
+		if *dcso.Status == "FAILED" {
+			if !strings.Contains(reason, "No updates") &&
+				!strings.Contains(reason, "didn't contain changes") {
+				return nil, fmt.Errorf("change set creation failed: %s", reason)
+			}
+			log.Printf("INFO: %s: No changes detected", name)
+			cs.outcome = outcomeNoChange
+			return cs, nil
+		}
+	}
+	for {
+		for _, c := range dcso.Changes {
+			if rc := c.ResourceChange; rc != nil {
+				cs.changes = append(cs.changes, policyChange{
+					Action:       aws.StringValue(rc.Action),
+					LogicalID:    aws.StringValue(rc.LogicalResourceId),
+					ResourceType: aws.StringValue(rc.ResourceType),
+					Replacement:  aws.StringValue(rc.Replacement),
+					Scope:        aws.StringValueSlice(rc.Scope),
+				})
+			}
+		}
+		if dcso.NextToken == nil {
+			break
+		}
+		dcso, err = cfmC.DescribeChangeSet(&cfm.DescribeChangeSetInput{ChangeSetName: result.Id, NextToken: dcso.NextToken})
+		if err != nil {
+			return nil, fmt.Errorf("ERROR: Failed to describe change set: %v", err.Error())
+		}
+	}
+	return cs, nil
+}
+
+// execute executes the change set, unless it has no changes, and returns the exported outputs of the stack.
+func (cs *policyChangeSet) execute() (map[string][]string, error) {
+	if cs.outcome != outcomeNoChange {
+		err := executePolicyChangeSet(cs.cfmC, cs.name, cs.stackName, cs.id, cs.outcome)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dso, err := cs.cfmC.DescribeStacks(&cfm.DescribeStacksInput{StackName: aws.String(cs.stackName)})
+	if err != nil {
+		return nil, fmt.Errorf("ERROR: Failed to describe stack: %v", err.Error())
+	}
+	outputs := make(map[string][]string)
+	for _, so := range dso.Stacks[0].Outputs {
+		// Only exported outputs name an iam group parameter.
+		if so.ExportName == nil {
+			continue
+		}
+		outputs[*so.ExportName] = append(outputs[*so.ExportName], aws.StringValue(so.OutputValue))
+	}
+	return outputs, nil
+}
+
+// discard deletes the change set without executing it. A change set creating a stack leaves the
+// stack in REVIEW_IN_PROGRESS, so the stack is deleted as well.
+func (cs *policyChangeSet) discard() error {
+	_, err := cs.cfmC.DeleteChangeSet(&cfm.DeleteChangeSetInput{ChangeSetName: cs.id})
+	if err != nil {
+		return fmt.Errorf("ERROR: Failed to delete change set: %v", err.Error())
+	}
+	if cs.outcome == outcomeCreated {
+		_, err = cs.cfmC.DeleteStack(&cfm.DeleteStackInput{StackName: aws.String(cs.stackName)})
+		if err != nil {
+			return fmt.Errorf("ERROR: Failed to delete the stack %s under review: %v", cs.stackName, err.Error())
+		}
+	}
+	log.Printf("INFO: %s: change set deleted without executing it", cs.name)
 	return nil
 }
 
-func AddToGroups(input map[string][]string) error {
+// executePolicyChangeSet executes a ready change set and waits for the stack to be created or updated.
+// The name identifies the account and region in the logs.
+func executePolicyChangeSet(cfmC cloudformationiface.CloudFormationAPI, name, stackName string, changeSetID *string, outcome string) error {
+	log.Printf("INFO: %s: executing change set", name)
+	events := newStackEventTail(cfmC, name, stackName)
+	_, err := cfmC.ExecuteChangeSet(&cfm.ExecuteChangeSetInput{ChangeSetName: changeSetID})
+	if err != nil {
+		return fmt.Errorf("ERROR: Failed to execute change set: %v", err.Error())
+	}
+	if outcome == outcomeCreated {
+		err = events.wait(func() error {
+			return cfmC.WaitUntilStackCreateComplete(&cfm.DescribeStacksInput{StackName: aws.String(stackName)})
+		})
+		if err != nil {
+			return fmt.Errorf("ERROR: Failed to create stack: %v", err.Error())
+		}
+		log.Printf("INFO: %s: Stack is created successfully", name)
+	} else {
+		err = events.wait(func() error {
+			return cfmC.WaitUntilStackUpdateComplete(&cfm.DescribeStacksInput{StackName: aws.String(stackName)})
+		})
+		if err != nil {
+			return fmt.Errorf("ERROR: Failed to update stack: %v", err.Error())
+		}
+		log.Printf("INFO: %s: Stack is updated successfully", name)
+	}
+	return nil
+}
+
+func AddToGroups(cfg Config, input map[string][]string, cliParams map[string]string) error {
 	log.Println("INFO: Updating iam groups")
 	var org Organization
-	var a Account
 	org = readOrgYaml()
-	for _, ou := range org.OrganizationalUnits {
-		for _, acc := range ou.Accounts {
-			if acc.Alias == "aqfer-iam" {
-				a = acc
-			}
-		}
+	roles, err := org.roleAccounts()
+	if err != nil {
+		return err
+	}
+	a := roles[roleIdentityHub]
+	stackName := cfg.stackName(a.Alias)
+	orgAccAccessRole := cfg.accountRoleARN(a.ID)
+	roleParams := make(map[string]string)
+	for role, param := range roleParameters {
+		roleParams[param] = roles[role].ID
+	}
+	groups := make(map[string]string)
+	for k, v := range cliParams {
+		groups[k] = v
+	}
+	cfmC := getCfmClient(profile, orgAccAccessRole, cfg.Region)
+	dso, err := cfmC.DescribeStacks(&cfm.DescribeStacksInput{StackName: aws.String(stackName)})
+	if err != nil {
+		return fmt.Errorf("ERROR: Failed to describe the iam-groups stack %s of %s with: %v", stackName, a.Alias, err)
 	}
-	orgAccAccessRole := fmt.Sprintf("arn:aws:iam::%s:role/OrganizationAccountAccessRole", a.ID)
-	var params []*cfm.Parameter
-	cfmC := getCfmClient(profile, orgAccAccessRole)
-	dso, _ := cfmC.DescribeStacks(&cfm.DescribeStacksInput{StackName: aws.String(strings.Title(a.Alias) + "-Policies")})
 	for g, r := range input {
 		for _, p := range dso.Stacks[0].Parameters {
 			if g == *p.ParameterKey {
 				iamParams := strings.Split(*p.ParameterValue, ",")
 				iamParams = append(iamParams, r...)
-				params = append(params, &cfm.Parameter{ParameterKey: p.ParameterKey, ParameterValue: aws.String(strings.Join(uniq(iamParams), ","))})
+				groups[g] = strings.Join(uniq(iamParams), ",")
 			}
 		}
 	}
-	// templateBucket := "akhil-org-test"
-	templateKey := strings.Title(a.Alias) + "-Policies"
-	s3C := getS3Client(profile, orgRole)
-	content, err := ioutil.ReadFile(a.TemplateFile)
-	if err != nil {
-		return fmt.Errorf("ERROR: Failed to read the policy file %s", a.TemplateFile)
-	}
-	_, err = s3C.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(templateBucket),
-		Body:   bytes.NewReader(content),
-		Key:    aws.String(templateKey),
-	})
+	// The group members go on top of the command line parameters, like those go on top of organization.yaml.
+	params := stackParameters(org, a, roleParams, groups)
+	template, err := policyTemplate(cfg, org, a, cfg.Region, stackName, &bucketShare{})
 	if err != nil {
-		return fmt.Errorf("ERROR: Failed to upload template file: %v \n", err)
+		return err
 	}
-	grantee := "emailAddress=" + a.Email
-	_, err = s3C.PutObjectAcl(&s3.PutObjectAclInput{
-		Bucket:    aws.String(templateBucket),
-		Key:       aws.String(templateKey),
-		GrantRead: aws.String(grantee),
-	})
-	if err != nil {
-		return fmt.Errorf("ERROR: Failed to apply ACL to the uploaded template file with: %v", err)
+	if template.Parameters[homeRegionParameter] {
+		params = withHomeRegion(params, cfg.Region)
 	}
-	s3URL := fmt.Sprintf("https://%s.s3-%s.amazonaws.com/%s", templateBucket, defaultRegion, templateKey)
+	params = withPreviousValues(params, dso.Stacks[0].Parameters, template.Parameters)
 	stackInput := &cfm.UpdateStackInput{
 		Capabilities: aws.StringSlice([]string{"CAPABILITY_NAMED_IAM"}),
-		StackName:    aws.String(strings.Title(a.Alias) + "-Policies"),
-		TemplateURL:  aws.String(s3URL),
+		StackName:    aws.String(stackName),
+		TemplateURL:  template.templateURL(),
+		TemplateBody: template.templateBody(),
 		Parameters:   params,
+		Tags:         template.tags(),
 	}
 	log.Println("INFO: Updating the iam-groups stack")
+	events := newStackEventTail(cfmC, a.Alias+"/"+cfg.Region, stackName)
 	_, err = cfmC.UpdateStack(stackInput)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ValidationError" && strings.Contains(aerr.Message(), "No updates are to be performed") {
+		log.Println("INFO: The iam groups are up to date")
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("ERROR: Stack %s update failed with status: %v", strings.Title(a.Alias), err)
+		return fmt.Errorf("ERROR: Stack %s update failed with status: %v", stackName, err)
 	}
-	err = cfmC.WaitUntilStackUpdateComplete(&cfm.DescribeStacksInput{StackName: aws.String(templateKey)})
+	err = events.wait(func() error {
+		return cfmC.WaitUntilStackUpdateComplete(&cfm.DescribeStacksInput{StackName: aws.String(stackName)})
+	})
 	if err != nil {
 		return fmt.Errorf("ERROR: Failed to update the iam-groups stack with: %v", err)
 	}
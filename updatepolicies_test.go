@@ -0,0 +1,518 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/annemakhil/org-governor/fakeaws"
+	"github.com/aws/aws-sdk-go/aws"
+	cfm "github.com/aws/aws-sdk-go/service/cloudformation"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUpdatePolicies(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	prodID := fake.org.AddAccount(fake.org.RootID(), "prod", "prod@example.com")
+	devID := fake.org.AddAccount(fake.org.RootID(), "dev", "dev@example.com")
+	writeOrgYaml(Organization{OrganizationalUnits: []OrganizationalUnit{{Name: "Workloads", Accounts: []Account{
+		iam,
+		{ID: prodID, Alias: "prod", Email: "prod@example.com", TemplateFile: writeTemplate(t, "Prod-Policies"), Role: roleProduction},
+		{ID: devID, Alias: "dev", Email: "dev@example.com", TemplateFile: writeTemplate(t, "Dev-Policies")},
+	}}}})
+
+	// The templates are small enough to be passed inline, no template bucket is needed.
+	cfg := testConfig
+	cfg.TemplateBucket = ""
+	if err := UpdatePolicies(cfg, []string{"dev"}, policyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	s := fake.account(devID).Stack("Dev-Policies")
+	if s == nil || s.Status != cfm.StackStatusCreateComplete {
+		t.Fatalf("stack = %+v", s)
+	}
+	params := map[string]string{}
+	for _, p := range s.Parameters {
+		params[*p.ParameterKey] = *p.ParameterValue
+	}
+	if params["IamAccountID"] != iam.ID || params["ProdccountID"] != prodID {
+		t.Errorf("stack parameters = %v", params)
+	}
+	if s.TemplateBody != testTemplate || s.TemplateURL != "" {
+		t.Errorf("template body = %q, URL = %q", s.TemplateBody, s.TemplateURL)
+	}
+	if len(s.Tags) != 1 || *s.Tags[0].Key != templateHashTag || *s.Tags[0].Value != templateHash([]byte(testTemplate)) {
+		t.Fatalf("stack tags = %v", s.Tags)
+	}
+
+	// A second run without changes leaves the stack alone.
+	if err := UpdatePolicies(cfg, []string{"dev"}, policyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if s := fake.account(devID).Stack("Dev-Policies"); s.Status != cfm.StackStatusCreateComplete {
+		t.Errorf("stack status = %s after a run without changes", s.Status)
+	}
+	if fake.s3.Uploads() != 0 {
+		t.Errorf("%d inline templates were uploaded", fake.s3.Uploads())
+	}
+	if fake.s3.PolicyUpdates() != 0 {
+		t.Errorf("the bucket policy was written without an upload: %s", fake.s3.Policy(testConfig.TemplateBucket))
+	}
+}
+
+func TestUpdatePoliciesLargeTemplate(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	devID := fake.org.AddAccount(fake.org.RootID(), "dev", "dev@example.com")
+	writeOrgYaml(Organization{OrganizationalUnits: []OrganizationalUnit{{Name: "Workloads", Accounts: []Account{
+		iam,
+		{ID: devID, Alias: "dev", Email: "dev@example.com", TemplateFile: writeLargeTemplate(t, "Dev-Policies")},
+	}}}})
+
+	cfg := testConfig
+	cfg.TemplateBucket = ""
+	if err := UpdatePolicies(cfg, []string{"dev"}, policyOptions{}); err == nil || fake.account(devID).Stack("Dev-Policies") != nil {
+		t.Fatalf("a template over the inline limit was deployed without a bucket, err = %v", err)
+	}
+	if err := UpdatePolicies(testConfig, []string{"dev"}, policyOptions{DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.s3.PolicyUpdates() != 0 {
+		t.Errorf("a dry run wrote the bucket policy: %s", fake.s3.Policy(testConfig.TemplateBucket))
+	}
+
+	if err := UpdatePolicies(testConfig, []string{"dev"}, policyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	s := fake.account(devID).Stack("Dev-Policies")
+	if s == nil || s.Status != cfm.StackStatusCreateComplete {
+		t.Fatalf("stack = %+v", s)
+	}
+	key := "Dev-Policies/" + *s.Tags[0].Value
+	if s.TemplateURL != testConfig.templateURL(key) || s.TemplateBody != "" {
+		t.Errorf("template URL = %q, body of %d bytes", s.TemplateURL, len(s.TemplateBody))
+	}
+	if _, ok := fake.s3.Object(testConfig.TemplateBucket, key); !ok {
+		t.Error("template was not uploaded")
+	}
+	if !strings.Contains(fake.s3.Policy(testConfig.TemplateBucket), fakeaws.OrganizationID) {
+		t.Errorf("bucket policy = %s", fake.s3.Policy(testConfig.TemplateBucket))
+	}
+
+	// A second run without changes leaves the stack and the uploaded template alone.
+	uploads := fake.s3.Uploads()
+	if err := UpdatePolicies(testConfig, []string{"dev"}, policyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if s := fake.account(devID).Stack("Dev-Policies"); s.Status != cfm.StackStatusCreateComplete {
+		t.Errorf("stack status = %s after a run without changes", s.Status)
+	}
+	if fake.s3.Uploads() != uploads {
+		t.Errorf("the unchanged template was uploaded again")
+	}
+}
+
+func TestUpdatePoliciesAddToGroups(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	devID := fake.org.AddAccount(fake.org.RootID(), "dev", "dev@example.com")
+	iam.Parameters = map[string]string{"Environment": "identity"}
+	writeOrgYaml(Organization{Parameters: map[string]string{"Owner": "platform"}, OrganizationalUnits: []OrganizationalUnit{{Name: "Workloads", Accounts: []Account{
+		iam,
+		{ID: devID, Alias: "dev", Email: "dev@example.com", TemplateFile: writeTemplate(t, "Dev-Policies")},
+	}}}})
+	fake.account(devID).Outputs["Dev-Policies"] = []*cfm.Output{
+		{OutputKey: aws.String("DeveloperRole"), ExportName: aws.String("Developers"), OutputValue: aws.String("arn:aws:iam::2:role/dev")},
+		// Outputs without an export are not iam group members, they are ignored.
+		{OutputKey: aws.String("DeveloperRoleName"), OutputValue: aws.String("dev")},
+	}
+
+	if err := UpdatePolicies(testConfig, []string{"dev"}, policyOptions{UpdateIAM: true}); err != nil {
+		t.Fatal(err)
+	}
+	s := fake.account(iam.ID).Stack("Identity-Policies")
+	got := make(map[string]string)
+	for _, p := range s.Parameters {
+		got[*p.ParameterKey] = *p.ParameterValue
+	}
+	// The parameters of organization.yaml survive the group update.
+	want := map[string]string{
+		"Developers":   "arn:aws:iam::1:role/existing,arn:aws:iam::2:role/dev",
+		"Environment":  "identity",
+		"Owner":        "platform",
+		"IamAccountID": iam.ID,
+		"ProdccountID": "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("identity stack parameters = %v, want %v", got, want)
+	}
+
+	// A second run finds the groups up to date.
+	if err := UpdatePolicies(testConfig, []string{"dev"}, policyOptions{UpdateIAM: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The command line parameters take precedence over organization.yaml for the iam groups stack too.
+	if err := UpdatePolicies(testConfig, []string{"dev"}, policyOptions{UpdateIAM: true, Parameters: map[string]string{"Environment": "cli"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range fake.account(iam.ID).Stack("Identity-Policies").Parameters {
+		if *p.ParameterKey == "Environment" && *p.ParameterValue != "cli" {
+			t.Errorf("identity stack Environment = %s, want cli", *p.ParameterValue)
+		}
+	}
+}
+
+func TestUpdatePoliciesKeepsGroupMembers(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	devID := fake.org.AddAccount(fake.org.RootID(), "dev", "dev@example.com")
+	// The identity template declares two groups, no stack exports members of Admins.
+	identityTemplate := strings.Replace(testTemplate, `"Parameters": {`, `"Parameters": {
+    "Developers": {"Type": "String", "Default": ""},
+    "Admins": {"Type": "String", "Default": ""},`, 1)
+	if err := ioutil.WriteFile(iam.TemplateFile, []byte(identityTemplate), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fake.account(iam.ID).PutStack(fakeStack("Identity-Policies",
+		&cfm.Parameter{ParameterKey: aws.String("Developers"), ParameterValue: aws.String("arn:aws:iam::1:role/existing")},
+		&cfm.Parameter{ParameterKey: aws.String("Admins"), ParameterValue: aws.String("arn:aws:iam::1:role/admin")},
+	))
+	writeOrgYaml(Organization{Accounts: []Account{iam}, OrganizationalUnits: []OrganizationalUnit{{Name: "Workloads", Accounts: []Account{
+		{ID: devID, Alias: "dev", Email: "dev@example.com", TemplateFile: writeTemplate(t, "Dev-Policies")},
+	}}}})
+	fake.account(devID).Outputs["Dev-Policies"] = []*cfm.Output{
+		{ExportName: aws.String("Developers"), OutputValue: aws.String("arn:aws:iam::2:role/dev")},
+	}
+	groups := func() map[string]string {
+		got := make(map[string]string)
+		for _, p := range fake.account(iam.ID).Stack("Identity-Policies").Parameters {
+			got[*p.ParameterKey] = *p.ParameterValue
+		}
+		return got
+	}
+
+	if err := UpdatePolicies(testConfig, []string{"dev"}, policyOptions{UpdateIAM: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := groups(); got["Developers"] != "arn:aws:iam::1:role/existing,arn:aws:iam::2:role/dev" || got["Admins"] != "arn:aws:iam::1:role/admin" {
+		t.Errorf("identity stack groups after the iam update = %v", got)
+	}
+
+	// The identity hub's own deployment keeps the members too.
+	if err := UpdatePolicies(testConfig, []string{"identity"}, policyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := groups(); got["Developers"] != "arn:aws:iam::1:role/existing,arn:aws:iam::2:role/dev" || got["Admins"] != "arn:aws:iam::1:role/admin" {
+		t.Errorf("identity stack groups after its deployment = %v", got)
+	}
+}
+
+func TestUpdatePoliciesAddToGroupsWithoutStack(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iamID := fake.org.AddAccount(fake.org.RootID(), "identity", "iam@example.com")
+	devID := fake.org.AddAccount(fake.org.RootID(), "dev", "dev@example.com")
+	// The identity hub was just given its role, its stack is not deployed yet.
+	writeOrgYaml(Organization{OrganizationalUnits: []OrganizationalUnit{{Name: "Workloads", Accounts: []Account{
+		{ID: iamID, Alias: "identity", Email: "iam@example.com", TemplateFile: writeTemplate(t, "Identity-Policies"), Role: roleIdentityHub},
+		{ID: devID, Alias: "dev", Email: "dev@example.com", TemplateFile: writeTemplate(t, "Dev-Policies")},
+	}}}})
+
+	err := UpdatePolicies(testConfig, []string{"dev"}, policyOptions{UpdateIAM: true})
+	if err == nil || !strings.Contains(err.Error(), "Identity-Policies") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestUpdatePoliciesParallel(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	ou := OrganizationalUnit{Name: "Workloads", Accounts: []Account{iam}}
+	var aliases []string
+	for i := 0; i < 12; i++ {
+		alias := fmt.Sprintf("team-%d", i)
+		id := fake.org.AddAccount(fake.org.RootID(), alias, alias+"@example.com")
+		stack := strings.Title(alias) + "-Policies"
+		ou.Accounts = append(ou.Accounts, Account{ID: id, Alias: alias, Email: alias + "@example.com", TemplateFile: writeTemplate(t, stack)})
+		fake.account(id).Outputs[stack] = []*cfm.Output{
+			{ExportName: aws.String("Developers"), OutputValue: aws.String("arn:aws:iam::" + id + ":role/dev")},
+		}
+		aliases = append(aliases, alias)
+	}
+	// The template of the last account is missing, it fails without stopping the others.
+	ou.Accounts[len(ou.Accounts)-1].TemplateFile = "policies/missing"
+	writeOrgYaml(Organization{OrganizationalUnits: []OrganizationalUnit{ou}})
+
+	err := UpdatePolicies(testConfig, aliases, policyOptions{UpdateIAM: true, Parallelism: 4})
+	if err == nil || !strings.Contains(err.Error(), "1 stack(s): team-11/us-west-2") {
+		t.Fatalf("err = %v", err)
+	}
+	for _, a := range ou.Accounts[1:11] {
+		if s := fake.account(a.ID).Stack(strings.Title(a.Alias) + "-Policies"); s == nil {
+			t.Errorf("stack of %s was not created", a.Alias)
+		}
+	}
+	s := fake.account(iam.ID).Stack("Identity-Policies")
+	if got := strings.Count(*s.Parameters[0].ParameterValue, ","); got != 11 {
+		t.Errorf("identity stack Developers = %s, want 12 roles", *s.Parameters[0].ParameterValue)
+	}
+}
+
+func TestUpdatePoliciesFailFast(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	var accounts []Account
+	for _, alias := range []string{"broken", "dev", "qa"} {
+		id := fake.org.AddAccount(fake.org.RootID(), alias, alias+"@example.com")
+		accounts = append(accounts, Account{ID: id, Alias: alias, Email: alias + "@example.com", TemplateFile: writeTemplate(t, strings.Title(alias)+"-Policies")})
+	}
+	accounts[0].TemplateFile = "policies/missing"
+	writeOrgYaml(Organization{Accounts: []Account{iam}, OrganizationalUnits: []OrganizationalUnit{{Name: "Workloads", Accounts: accounts}}})
+
+	err := UpdatePolicies(testConfig, []string{"broken", "dev", "qa", "unknown"}, policyOptions{Parallelism: 1, FailFast: true})
+	if err == nil || !strings.Contains(err.Error(), "2 stack(s): unknown, broken/us-west-2") {
+		t.Fatalf("err = %v", err)
+	}
+	for _, a := range accounts[1:] {
+		if s := fake.account(a.ID).Stack(strings.Title(a.Alias) + "-Policies"); s != nil {
+			t.Errorf("stack of %s was deployed after a failure", a.Alias)
+		}
+	}
+
+	err = UpdatePolicies(testConfig, []string{"broken", "dev", "qa"}, policyOptions{Parallelism: 1})
+	if err == nil || !strings.Contains(err.Error(), "1 stack(s): broken/us-west-2") {
+		t.Fatalf("err = %v", err)
+	}
+	for _, a := range accounts[1:] {
+		if s := fake.account(a.ID).Stack(strings.Title(a.Alias) + "-Policies"); s == nil {
+			t.Errorf("stack of %s was not deployed", a.Alias)
+		}
+	}
+}
+
+func TestUpdatePoliciesRegions(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	devID := fake.org.AddAccount(fake.org.RootID(), "dev", "dev@example.com")
+	qaID := fake.org.AddAccount(fake.org.RootID(), "qa", "qa@example.com")
+	// The template of dev pins its IAM resources to the home region.
+	devTemplate := strings.Replace(testTemplate, `"Parameters": {`, `"Parameters": {
+    "HomeRegion": {"Type": "String"},`, 1)
+	if err := ioutil.WriteFile(filepath.Join("policies", "Dev-Policies"), []byte(devTemplate), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeOrgYaml(Organization{Accounts: []Account{iam}, OrganizationalUnits: []OrganizationalUnit{{
+		Name:    "Workloads",
+		Regions: []string{"eu-west-1", "us-east-1"},
+		Accounts: []Account{
+			{ID: devID, Alias: "dev", Email: "dev@example.com", TemplateFile: "policies/Dev-Policies"},
+			{ID: qaID, Alias: "qa", Email: "qa@example.com", TemplateFile: writeTemplate(t, "Qa-Policies"), Regions: []string{"ap-south-1"}},
+		},
+	}}})
+	for _, region := range []string{testConfig.Region, "eu-west-1", "us-east-1"} {
+		fake.region(devID, region).Outputs["Dev-Policies"] = []*cfm.Output{
+			{ExportName: aws.String("Developers"), OutputValue: aws.String("arn:aws:iam::" + devID + ":role/dev-" + region)},
+		}
+	}
+
+	if err := UpdatePolicies(testConfig, []string{"dev", "qa"}, policyOptions{UpdateIAM: true, Parallelism: 2}); err != nil {
+		t.Fatal(err)
+	}
+	deployed := map[string][]string{
+		"Dev-Policies": {devID, testConfig.Region, "eu-west-1", "us-east-1"},
+		"Qa-Policies":  {qaID, testConfig.Region, "ap-south-1"},
+	}
+	for stack, placement := range deployed {
+		for _, region := range placement[1:] {
+			if fake.region(placement[0], region).Stack(stack) == nil {
+				t.Errorf("%s was not deployed in %s", stack, region)
+			}
+		}
+	}
+	if s := fake.region(qaID, "eu-west-1").Stack("Qa-Policies"); s != nil {
+		t.Error("the regions of the account should override the regions of its OU")
+	}
+	// Every region of dev gets the home region, qa does not declare it.
+	for _, region := range deployed["Dev-Policies"][1:] {
+		home := ""
+		for _, p := range fake.region(devID, region).Stack("Dev-Policies").Parameters {
+			if *p.ParameterKey == homeRegionParameter {
+				home = *p.ParameterValue
+			}
+		}
+		if home != testConfig.Region {
+			t.Errorf("HomeRegion of Dev-Policies in %s = %q, want %s", region, home, testConfig.Region)
+		}
+	}
+	for _, p := range fake.region(qaID, "ap-south-1").Stack("Qa-Policies").Parameters {
+		if *p.ParameterKey == homeRegionParameter {
+			t.Error("HomeRegion is passed to a template not declaring it")
+		}
+	}
+	// Only the home region outputs reach the iam groups.
+	s := fake.account(iam.ID).Stack("Identity-Policies")
+	if got := *s.Parameters[0].ParameterValue; got != "arn:aws:iam::1:role/existing,arn:aws:iam::"+devID+":role/dev-"+testConfig.Region {
+		t.Errorf("identity stack Developers = %s", got)
+	}
+}
+
+func TestUpdatePoliciesDryRun(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	devID := fake.org.AddAccount(fake.org.RootID(), "dev", "dev@example.com")
+	qaID := fake.org.AddAccount(fake.org.RootID(), "qa", "qa@example.com")
+	writeOrgYaml(Organization{Accounts: []Account{iam}, OrganizationalUnits: []OrganizationalUnit{{Name: "Workloads", Accounts: []Account{
+		{ID: devID, Alias: "dev", Email: "dev@example.com", TemplateFile: writeTemplate(t, "Dev-Policies")},
+		{ID: qaID, Alias: "qa", Email: "qa@example.com", TemplateFile: writeTemplate(t, "Qa-Policies")},
+	}}}})
+	if err := UpdatePolicies(testConfig, []string{"dev"}, policyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	before := fake.account(devID).Stack("Dev-Policies")
+	fake.account(devID).Changes["Dev-Policies"] = []*cfm.Change{{ResourceChange: &cfm.ResourceChange{
+		Action:            aws.String(cfm.ChangeActionModify),
+		LogicalResourceId: aws.String("DeveloperRole"),
+		ResourceType:      aws.String("AWS::IAM::Role"),
+		Replacement:       aws.String(cfm.ReplacementTrue),
+		Scope:             aws.StringSlice([]string{cfm.ResourceAttributeProperties}),
+	}}}
+
+	// The replacement of the role is blocked, the dry run previews it flagged without failing.
+	opts := policyOptions{DryRun: true, Output: outputJSON, Parameters: map[string]string{"Env": "dev"}}
+	out := captureStdout(t, func() {
+		if err := UpdatePolicies(testConfig, []string{"dev", "qa"}, opts); err != nil {
+			t.Fatal(err)
+		}
+	})
+	var previews []policyPreview
+	if err := json.Unmarshal([]byte(out), &previews); err != nil {
+		t.Fatalf("dry run output %q: %v", out, err)
+	}
+	if len(previews) != 2 {
+		t.Fatalf("previews = %+v", previews)
+	}
+	if p := previews[0]; p.Outcome != outcomeWouldUpdate || len(p.Changes) != 1 || p.Changes[0].LogicalID != "DeveloperRole" || !strings.Contains(p.Error, "DeveloperRole") {
+		t.Errorf("dev preview = %+v", p)
+	}
+	if after := fake.account(devID).Stack("Dev-Policies"); fmt.Sprint(after.Parameters) != fmt.Sprint(before.Parameters) {
+		t.Errorf("dry run executed the change set, parameters = %v", after.Parameters)
+	}
+	if s := fake.account(qaID).Stack("Qa-Policies"); s != nil {
+		t.Errorf("dry run left the new stack behind with status %s", s.Status)
+	}
+	// The stack deleted after the preview can still be created.
+	if err := UpdatePolicies(testConfig, []string{"qa"}, policyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpdatePoliciesUnknownAccount(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	devID := fake.org.AddAccount(fake.org.RootID(), "dev", "dev@example.com")
+	writeOrgYaml(Organization{OrganizationalUnits: []OrganizationalUnit{{Name: "Workloads", Accounts: []Account{
+		iam,
+		{ID: devID, Alias: "dev", Email: "dev@example.com", TemplateFile: writeTemplate(t, "Dev-Policies")},
+	}}}})
+
+	err := UpdatePolicies(testConfig, []string{"dev", "ops"}, policyOptions{})
+	if err == nil || !strings.Contains(err.Error(), "ops") || strings.Contains(err.Error(), "dev") {
+		t.Errorf("err = %v", err)
+	}
+	if s := fake.account(devID).Stack("Dev-Policies"); s == nil || s.Status != cfm.StackStatusCreateComplete {
+		t.Errorf("the known account was not deployed, stack = %+v", s)
+	}
+}
+
+func TestPrintPolicyChanges(t *testing.T) {
+	results := []policyResult{
+		{Alias: "dev", Region: "us-west-2", Outcome: outcomeWouldUpdate, Changes: []policyChange{
+			{Action: "Modify", LogicalID: "DeveloperRole", ResourceType: "AWS::IAM::Role", Replacement: "True", Scope: []string{"Properties", "Tags"}},
+			{Action: "Add", LogicalID: "AuditPolicy", ResourceType: "AWS::IAM::ManagedPolicy"},
+		}},
+		{Alias: "qa", Region: "us-west-2", Outcome: outcomeNoChange},
+		{Alias: "ops", Outcome: outcomeFailed, Err: fmt.Errorf("not in organization.yaml")},
+	}
+
+	var table strings.Builder
+	printPolicyChanges(&table, results)
+	want := `ACCOUNT  REGION     ACTION  LOGICAL ID     TYPE                     REPLACEMENT  SCOPE
+dev      us-west-2  Modify  DeveloperRole  AWS::IAM::Role           True         Properties,Tags
+dev      us-west-2  Add     AuditPolicy    AWS::IAM::ManagedPolicy  -            
+`
+	if table.String() != want {
+		t.Errorf("table:\n%s\nwant:\n%s", table.String(), want)
+	}
+
+	var out strings.Builder
+	if err := printPolicyChangesJSON(&out, results); err != nil {
+		t.Fatal(err)
+	}
+	var previews []policyPreview
+	if err := json.Unmarshal([]byte(out.String()), &previews); err != nil {
+		t.Fatalf("invalid JSON %s: %v", out.String(), err)
+	}
+	if len(previews) != 3 || len(previews[0].Changes) != 2 || previews[0].Changes[0].Replacement != "True" ||
+		previews[1].Changes == nil || previews[2].Error != "not in organization.yaml" {
+		t.Errorf("previews = %+v", previews)
+	}
+}
+
+func TestStackParameters(t *testing.T) {
+	org := Organization{
+		Parameters: map[string]string{"Env": "global", "Owner": "platform", "Budget": "100"},
+		OrganizationalUnits: []OrganizationalUnit{{
+			Name:       "Workloads",
+			Parameters: map[string]string{"Env": "workloads", "Owner": "workloads"},
+			OrganizationalUnits: []OrganizationalUnit{{
+				Name:       "Prod",
+				Parameters: map[string]string{"Env": "prod"},
+				Accounts:   []Account{{Alias: "data", Parameters: map[string]string{"Owner": "data-team", "Budget": "500"}}},
+			}},
+		}},
+	}
+	a := org.OrganizationalUnits[0].OrganizationalUnits[0].Accounts[0]
+	cliParams, err := parseParameters([]string{"Budget=900", "Groups=dev", "ops"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, p := range stackParameters(org, a, map[string]string{"IamAccountID": "1", "Env": "default"}, cliParams) {
+		got[*p.ParameterKey] = *p.ParameterValue
+	}
+	want := map[string]string{"IamAccountID": "1", "Env": "prod", "Owner": "data-team", "Budget": "900", "Groups": "dev,ops"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("parameters = %v, want %v", got, want)
+	}
+	if _, err := parseParameters([]string{"novalue"}); err == nil {
+		t.Error("parseParameters accepted a pair without '='")
+	}
+}
+
+func TestRoleAccounts(t *testing.T) {
+	tests := []struct {
+		accounts []Account
+		err      string
+	}{
+		{accounts: []Account{{Alias: "a", Role: roleIdentityHub}, {Alias: "b", Role: roleProduction}}},
+		{accounts: []Account{{Alias: "a", Role: roleProduction}}, err: "No account has the role identity-hub"},
+		{accounts: []Account{{Alias: "a", Role: roleIdentityHub}, {Alias: "b", Role: roleIdentityHub}}, err: "both have the role"},
+		{accounts: []Account{{Alias: "a", Role: roleIdentityHub}, {Alias: "b", Role: "billing"}}, err: "unknown role billing"},
+	}
+	for _, tt := range tests {
+		org := Organization{OrganizationalUnits: []OrganizationalUnit{{Name: "Workloads", Accounts: tt.accounts}}}
+		roles, err := org.roleAccounts()
+		if tt.err == "" {
+			if err != nil || roles[roleIdentityHub].Alias != "a" {
+				t.Errorf("roleAccounts(%v) = %v, %v", tt.accounts, roles, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("roleAccounts(%v) error = %v, want %q", tt.accounts, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	cfm "github.com/aws/aws-sdk-go/service/cloudformation"
+	"gopkg.in/yaml.v2"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// validateOptions are the settings of the validate command.
+type validateOptions struct {
+	// Parameters are the stack parameters given on the command line, as update-policy would get them.
+	Parameters map[string]string
+	// Remote also sends the templates to the CloudFormation ValidateTemplate API.
+	Remote bool
+}
+
+// templateSpec is the part of a CloudFormation template the validation looks at. The intrinsic
+// function tags of YAML templates, like !Ref, are ignored by the YAML decoder.
+type templateSpec struct {
+	Parameters map[string]struct {
+		Type    string      `yaml:"Type" json:"Type"`
+		Default interface{} `yaml:"Default" json:"Default"`
+	} `yaml:"Parameters" json:"Parameters"`
+	Outputs map[string]struct {
+		Export *struct {
+			Name interface{} `yaml:"Name" json:"Name"`
+		} `yaml:"Export" json:"Export"`
+	} `yaml:"Outputs" json:"Outputs"`
+}
+
+// parseTemplate parses a JSON or YAML CloudFormation template.
+func parseTemplate(content []byte) (templateSpec, error) {
+	var spec templateSpec
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		return spec, json.Unmarshal(content, &spec)
+	}
+	return spec, yaml.Unmarshal(content, &spec)
+}
+
+// declaredParameters returns the parameters a template declares. A template that does not parse
+// declares nothing, templateProblems reports it.
+func declaredParameters(content []byte) map[string]bool {
+	declared := make(map[string]bool)
+	spec, err := parseTemplate(content)
+	if err != nil {
+		return declared
+	}
+	for name := range spec.Parameters {
+		declared[name] = true
+	}
+	return declared
+}
+
+// templateProblems returns what would make the deployment of a template fail or leave the iam
+// groups out of date: parameters passed by update-policy the template does not declare, required
+// parameters nobody supplies and exports without a Name. The warnings are the outputs that are not
+// exported, they deploy fine but AddToGroups skips them.
+func templateProblems(content []byte, params []*cfm.Parameter) (problems, warnings []string) {
+	spec, err := parseTemplate(content)
+	if err != nil {
+		return []string{fmt.Sprintf("template does not parse: %v", err)}, nil
+	}
+	passed := make(map[string]bool)
+	for _, p := range params {
+		passed[*p.ParameterKey] = true
+		if _, ok := spec.Parameters[*p.ParameterKey]; !ok {
+			problems = append(problems, fmt.Sprintf("parameter %s is passed but not declared", *p.ParameterKey))
+		}
+	}
+	var names []string
+	for name := range spec.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if spec.Parameters[name].Default == nil && !passed[name] {
+			problems = append(problems, fmt.Sprintf("required parameter %s is not supplied", name))
+		}
+	}
+	names = nil
+	for name := range spec.Outputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch export := spec.Outputs[name].Export; {
+		case export == nil:
+			warnings = append(warnings, fmt.Sprintf("output %s is not exported, it does not reach the iam groups", name))
+		case export.Name == nil:
+			problems = append(problems, fmt.Sprintf("output %s has an Export without a Name", name))
+		}
+	}
+	return problems, warnings
+}
+
+// ValidateTemplates checks the policy templates of the accounts against the parameters
+// update-policy would pass them, without uploading or deploying anything. Every account is
+// checked when acc is empty.
+func ValidateTemplates(cfg Config, acc []string, opts validateOptions) error {
+	org := readOrgYaml()
+	roles, err := org.roleAccounts()
+	if err != nil {
+		return err
+	}
+	roleParams := make(map[string]string)
+	for role, param := range roleParameters {
+		roleParams[param] = roles[role].ID
+	}
+	accounts := org.allAccounts()
+	if len(acc) > 0 {
+		accounts = nil
+		for _, alias := range acc {
+			found := false
+			for _, a := range org.allAccounts() {
+				if a.Alias == alias {
+					accounts = append(accounts, a)
+					found = true
+				}
+			}
+			if !found {
+				return fmt.Errorf("ERROR: Account %s is not in organization.yaml", alias)
+			}
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ACCOUNT\tTEMPLATE\tRESULT")
+	var failed []string
+	for _, a := range accounts {
+		var problems, warnings []string
+		file := cfg.templateFile(a)
+		content, err := readPolicyTemplate(cfg, org, a, cfg.Region)
+		if err != nil {
+			problems = []string{err.Error()}
+		} else {
+			params := stackParameters(org, a, roleParams, opts.Parameters)
+			if declaredParameters(content)[homeRegionParameter] {
+				params = withHomeRegion(params, cfg.Region)
+			}
+			problems, warnings = templateProblems(content, params)
+		}
+		if err == nil && opts.Remote {
+			if len(content) > maxTemplateBodySize {
+				log.Printf("INFO: %s: %s is over the inline limit, it is not sent to ValidateTemplate", a.Alias, file)
+			} else {
+				cfmC := getCfmClient(profile, orgRole, cfg.Region)
+				_, verr := cfmC.ValidateTemplate(&cfm.ValidateTemplateInput{TemplateBody: aws.String(string(content))})
+				if verr != nil {
+					problems = append(problems, fmt.Sprintf("ValidateTemplate: %v", verr))
+				}
+			}
+		}
+		for _, warning := range warnings {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", a.Alias, file, "warning: "+warning)
+		}
+		if len(problems) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", a.Alias, file, "ok")
+			continue
+		}
+		failed = append(failed, a.Alias)
+		for _, p := range problems {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", a.Alias, file, p)
+		}
+	}
+	w.Flush()
+	if len(failed) > 0 {
+		return fmt.Errorf("ERROR: The templates of %s have problems", strings.Join(failed, ", "))
+	}
+	return nil
+}
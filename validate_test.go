@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	cfm "github.com/aws/aws-sdk-go/service/cloudformation"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const yamlTemplate = `AWSTemplateFormatVersion: "2010-09-09"
+Parameters:
+  IamAccountID:
+    Type: String
+  Env:
+    Type: String
+  Owner:
+    Type: String
+    Default: ""
+Resources:
+  DeveloperRole:
+    Type: AWS::IAM::Role
+    Properties:
+      RoleName: !Sub "${Env}-developer"
+Outputs:
+  DeveloperRoleArn:
+    Value: !GetAtt DeveloperRole.Arn
+    Export:
+      Name: Developers
+  DeveloperRoleName:
+    Value: !Ref DeveloperRole
+`
+
+func TestTemplateProblems(t *testing.T) {
+	param := func(k string) *cfm.Parameter {
+		return &cfm.Parameter{ParameterKey: aws.String(k), ParameterValue: aws.String("v")}
+	}
+	tests := []struct {
+		name     string
+		content  string
+		params   []*cfm.Parameter
+		want     []string
+		warnings []string
+	}{
+		{name: "json", content: testTemplate, params: []*cfm.Parameter{param("IamAccountID"), param("ProdccountID")}},
+		{name: "yaml", content: yamlTemplate, params: []*cfm.Parameter{param("IamAccountID"), param("ProdccountID")}, want: []string{
+			"parameter ProdccountID is passed but not declared",
+			"required parameter Env is not supplied",
+		}, warnings: []string{
+			"output DeveloperRoleName is not exported",
+		}},
+		{name: "export without name", content: yamlTemplate + "    Export:\n      Value: x\n", params: []*cfm.Parameter{param("IamAccountID"), param("Env")}, want: []string{
+			"output DeveloperRoleName has an Export without a Name",
+		}},
+		{name: "broken", content: "Resources: [", want: []string{"template does not parse"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, warnings := templateProblems([]byte(tt.content), tt.params)
+			if len(got) != len(tt.want) {
+				t.Fatalf("problems = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if !strings.HasPrefix(got[i], tt.want[i]) {
+					t.Errorf("problem %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+			if len(warnings) != len(tt.warnings) {
+				t.Fatalf("warnings = %q, want %q", warnings, tt.warnings)
+			}
+			for i := range warnings {
+				if !strings.HasPrefix(warnings[i], tt.warnings[i]) {
+					t.Errorf("warning %d = %q, want %q", i, warnings[i], tt.warnings[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	fake := setupTest(t, Organization{})
+	iam := setupIdentityAccount(t, fake)
+	devID := fake.org.AddAccount(fake.org.RootID(), "dev", "dev@example.com")
+	devTemplate := filepath.Join("policies", "Dev-Policies.yaml")
+	if err := ioutil.WriteFile(devTemplate, []byte(strings.Replace(yamlTemplate, "  DeveloperRoleName:\n    Value: !Ref DeveloperRole\n", "", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeOrgYaml(Organization{Parameters: map[string]string{"ProdccountID": ""}, OrganizationalUnits: []OrganizationalUnit{{Name: "Workloads", Accounts: []Account{
+		iam,
+		{ID: devID, Alias: "dev", Email: "dev@example.com", TemplateFile: devTemplate, Parameters: map[string]string{"ProdccountID": "1"}},
+	}}}})
+
+	err := ValidateTemplates(testConfig, nil, validateOptions{})
+	if err == nil || !strings.Contains(err.Error(), "dev") || strings.Contains(err.Error(), "identity") {
+		t.Errorf("err = %v", err)
+	}
+	// Parameters given on the command line count as supplied, but ProdccountID is still undeclared.
+	err = ValidateTemplates(testConfig, []string{"dev"}, validateOptions{Parameters: map[string]string{"Env": "test"}})
+	if err == nil {
+		t.Error("the undeclared parameter was not reported")
+	}
+	if err := ValidateTemplates(testConfig, []string{"ops"}, validateOptions{}); err == nil || !strings.Contains(err.Error(), "ops") {
+		t.Errorf("err = %v", err)
+	}
+	if err := ValidateTemplates(testConfig, []string{"identity"}, validateOptions{Remote: true}); err != nil {
+		t.Errorf("err = %v", err)
+	}
+	// An output that is not exported only warns.
+	unexported := strings.Replace(testTemplate, `"Resources": {}`, `"Resources": {}, "Outputs": {"RoleName": {"Value": "admin"}}`, 1)
+	if err := ioutil.WriteFile(iam.TemplateFile, []byte(unexported), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateTemplates(testConfig, []string{"identity"}, validateOptions{}); err != nil {
+		t.Errorf("err = %v", err)
+	}
+	if err := ioutil.WriteFile(iam.TemplateFile, []byte(strings.Replace(testTemplate, `"Resources": {}`, `"Outputs": {}`, 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateTemplates(testConfig, []string{"identity"}, validateOptions{Remote: true}); err == nil || !strings.Contains(err.Error(), "identity") {
+		t.Errorf("err = %v", err)
+	}
+	if fake.s3.Uploads() != 0 {
+		t.Errorf("%d templates were uploaded", fake.s3.Uploads())
+	}
+}